@@ -2,26 +2,42 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/gillepool/botty/internal/adapter"
+	"github.com/gillepool/botty/internal/admin"
 	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/deadletter"
 	"github.com/gillepool/botty/internal/events"
+	"github.com/gillepool/botty/internal/journal"
 	"github.com/gillepool/botty/internal/message"
+	"github.com/gillepool/botty/internal/metrics"
+	"github.com/gillepool/botty/internal/scheduler"
 	"github.com/gillepool/botty/internal/storage"
+	"github.com/gillepool/botty/internal/tracing"
 	"github.com/gillepool/botty/pkg/logger"
 	"go.uber.org/zap"
 )
 
 type Bot struct {
-	Name    string
-	Adapter adapter.Adapter
-	Brain   *brain.Brain
-	Storage *storage.Storage
-	Logger  *zap.Logger
+	Name        string
+	Adapter     adapter.Adapter
+	Brain       *brain.Brain
+	Storage     *storage.Storage
+	DeadLetters *deadletter.Queue
+	Scheduler   *scheduler.Scheduler
+	Metrics     *metrics.Registry
+	Tracer      *tracing.Tracer // nil if tracing is disabled
+	Logger      *zap.Logger
 }
 
 func New(name string) *Bot {
@@ -32,17 +48,109 @@ func New(name string) *Bot {
 	storage.NewRedisStorage(storage.Config{
 		Addr: os.Getenv("redis_addr"),
 	})
-	brain := brain.NewBrain(logger.Named("Brain"))
 
-	adapter, _ := adapter.NewDiscordAdapter("Daniel", os.Getenv("discord_token"), logger.Named("Discord"))
+	// Keep the memory across restarts if a storage file is configured.
+	if path := os.Getenv("storage_path"); path != "" {
+		memory, err := storage.OpenFileMemory(path, clock.New())
+		if err != nil {
+			logger.Error("Failed to open storage file", zap.String("path", path), zap.Error(err))
+		} else {
+			store.SetMemory(memory)
+		}
+	}
+
+	registry := metrics.NewRegistry()
+	store.SetObserver(metrics.NewStorageMetrics(registry))
+	tracer := newTracer(name, logger.Named("Tracing"))
+	brain := brain.New(
+		brain.WithLogger(logger.Named("Brain")),
+		brain.WithMetrics(metrics.NewBrainMetrics(registry)),
+		brain.WithTracer(tracer),
+	)
+	deadLetters := deadletter.New(store, logger.Named("DeadLetters"))
+	brain.SetDeadLetterQueue(deadLetters)
+	scheduler := scheduler.New(brain, store, logger.Named("Scheduler"))
+
+	// Record all events if a journal file is configured, so they can be
+	// replayed when debugging.
+	if path := os.Getenv("journal_path"); path != "" {
+		j, err := journal.Create(path)
+		if err != nil {
+			logger.Error("Failed to open journal", zap.String("path", path), zap.Error(err))
+		} else {
+			brain.SetJournal(j)
+			brain.RegisterHandler(func(evt events.ShutdownEvent) error {
+				return j.Close()
+			})
+		}
+	}
+
+	discord, _ := adapter.NewDiscordAdapter("Daniel", os.Getenv("discord_token"), logger.Named("Discord"))
+	adapter := adapter.Trace(metrics.InstrumentAdapter(discord, "discord", registry), tracer)
+
+	// Serve the metrics if a listen address is configured.
+	if addr := os.Getenv("metrics_addr"); addr != "" {
+		server := metrics.NewServer(addr, registry)
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Metrics server failed", zap.String("addr", addr), zap.Error(err))
+			}
+		}()
+		brain.RegisterHandler(func(ctx context.Context, evt events.ShutdownEvent) error {
+			return server.Shutdown(ctx)
+		})
+	}
+
+	// Serve the health and readiness probes if a listen address is configured.
+	if addr := os.Getenv("admin_addr"); addr != "" {
+		probes := admin.NewServer(brain, 5*time.Minute)
+		probes.AddReadinessCheck("adapter", discord.Ping)
+		probes.AddReadinessCheck("memory", store.Ping)
+
+		server := &http.Server{Addr: addr, Handler: probes}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Admin server failed", zap.String("addr", addr), zap.Error(err))
+			}
+		}()
+		brain.RegisterHandler(func(ctx context.Context, evt events.ShutdownEvent) error {
+			return server.Shutdown(ctx)
+		})
+	}
 
 	logger.Info("Storaged used: ", zap.Any("Storage", store))
 	return &Bot{
-		Name:    name,
-		Brain:   brain,
-		Adapter: adapter,
-		Storage: store,
-		Logger:  logger,
+		Name:        name,
+		Brain:       brain,
+		Adapter:     adapter,
+		Storage:     store,
+		DeadLetters: deadLetters,
+		Scheduler:   scheduler,
+		Metrics:     registry,
+		Tracer:      tracer,
+		Logger:      logger,
+	}
+}
+
+// newTracer creates a Tracer if an OTLP collector or a trace file is
+// configured. The trace file "-" means that spans are written to stdout.
+func newTracer(service string, logger *zap.Logger) *tracing.Tracer {
+	if endpoint := os.Getenv("otlp_endpoint"); endpoint != "" {
+		return tracing.NewTracer(tracing.NewOTLPExporter(endpoint, service), logger)
+	}
+
+	switch path := os.Getenv("trace_path"); path {
+	case "":
+		return nil
+	case "-":
+		return tracing.NewTracer(tracing.NewWriterExporter(os.Stdout), logger)
+	default:
+		exporter, err := tracing.CreateFileExporter(path)
+		if err != nil {
+			logger.Error("Failed to open trace file", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		return tracing.NewTracer(exporter, logger)
 	}
 }
 
@@ -75,7 +183,7 @@ func (b *Bot) RespondRegexp(expr string, fun func(message.Message) error) {
 		return
 	}
 
-	b.Brain.RegisterHandler(func(ctx context.Context, evt events.ReceiveMessageEvent) error {
+	handler := func(ctx context.Context, evt events.ReceiveMessageEvent) error {
 		matches := regex.FindStringSubmatch(evt.Text)
 		if len(matches) == 0 {
 			return nil
@@ -93,7 +201,11 @@ func (b *Bot) RespondRegexp(expr string, fun func(message.Message) error) {
 			Matches:  matches[1:],
 			Adapter:  b.Adapter,
 		})
-	})
+	}
+
+	// The expression is used as name so failed messages can be retried from
+	// the dead letter queue.
+	b.Brain.RegisterHandlerWithOptions(handler, brain.HandlerOptions{Name: expr})
 }
 
 type ExampleBot struct {
@@ -103,10 +215,16 @@ type ExampleBot struct {
 func (b *Bot) Run() error {
 	fmt.Println("Run")
 	if len(b.Brain.RegistrationErrs) > 0 {
-		return fmt.Errorf("invalid event handlers: %w", b.Brain.RegistrationErrs)
+		return fmt.Errorf("invalid event handlers: %v", b.Brain.RegistrationErrs)
 	}
 
 	b.Adapter.RegisterAt(b.Brain)
+	b.Brain.RegisterHandler(func(evt events.InitEvent) error {
+		return b.Scheduler.Start()
+	})
+	b.Brain.RegisterHandler(func(evt events.ShutdownEvent) {
+		b.Scheduler.Stop()
+	})
 
 	b.Logger.Info("Initialize bot", zap.String("name", b.Name))
 	b.Brain.HandleEvents()
@@ -116,9 +234,38 @@ func (b *Bot) Run() error {
 	if err != nil {
 		b.Logger.Info("Error while closing memory", zap.Error(err))
 	}
+
+	if b.Tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Tracer.Shutdown(ctx); err != nil {
+			b.Logger.Info("Error while exporting remaining spans", zap.Error(err))
+		}
+	}
 	return nil
 }
 
+// ShutdownOnSignal shuts down the Brain when the process receives SIGINT or
+// SIGTERM, which makes Bot.Run return. Queued events are handled for at most
+// the given timeout.
+func (b *Bot) ShutdownOnSignal(timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		b.Logger.Info("Received signal, shutting down", zap.Stringer("signal", sig))
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := b.Brain.Shutdown(ctx); err != nil {
+			b.Logger.Error("Brain did not shut down cleanly", zap.Error(err))
+		}
+	}()
+}
+
 func main() {
 	bot := &ExampleBot{
 		Bot: New("Botty"),
@@ -126,14 +273,23 @@ func main() {
 
 	bot.Respond("remember (.+) is (.+)", bot.Remember)
 	bot.Respond("what is (.+)", bot.WhatIs)
-	bot.Run()
+	bot.Respond("rename (.+) to (.+)", bot.Rename)
+	bot.Respond("dead letters", bot.ListDeadLetters)
+	bot.Respond("show dead letter (.+)", bot.ShowDeadLetter)
+	bot.Respond("retry dead letter (.+)", bot.RetryDeadLetter)
+	bot.Respond("purge dead letters", bot.PurgeDeadLetters)
+
+	bot.ShutdownOnSignal(10 * time.Second)
+	if err := bot.Run(); err != nil {
+		bot.Logger.Fatal("Bot failed", zap.Error(err))
+	}
 }
 
 func (b *ExampleBot) Remember(msg message.Message) error {
 	b.Logger.Info("Remember command")
 	key, value := msg.Matches[0], msg.Matches[1]
 	msg.Respond("Ok I'll remember %s is %s", key, value)
-	return b.Storage.Set(key, value)
+	return b.Storage.SetContext(msg.Context, key, value)
 }
 
 func (b *ExampleBot) WhatIs(msg message.Message) error {
@@ -142,7 +298,7 @@ func (b *ExampleBot) WhatIs(msg message.Message) error {
 	key = strings.TrimSuffix(key, "\r")
 
 	var value string
-	ok, err := b.Storage.Get(key, &value)
+	ok, err := b.Storage.GetContext(msg.Context, key, &value)
 	if err != nil {
 		return err
 	}
@@ -154,3 +310,94 @@ func (b *ExampleBot) WhatIs(msg message.Message) error {
 	}
 	return nil
 }
+
+func (b *ExampleBot) Rename(msg message.Message) error {
+	from, to := msg.Matches[0], strings.TrimSuffix(msg.Matches[1], "\r")
+
+	var found bool
+	err := b.Storage.BatchContext(msg.Context, func(tx *storage.Tx) error {
+		var value string
+		ok, err := tx.Get(from, &value)
+		found = ok
+		if err != nil || !ok {
+			return err
+		}
+
+		if _, err := tx.Delete(from); err != nil {
+			return err
+		}
+		return tx.Set(to, value)
+	})
+	if errors.Is(err, storage.ErrTransactionsNotSupported) {
+		msg.Respond("Renaming is not supported by the storage")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if found {
+		msg.Respond("Ok %s is now called %s", from, to)
+	} else {
+		msg.Respond("Could not found %q stored", from)
+	}
+	return nil
+}
+
+func (b *ExampleBot) ListDeadLetters(msg message.Message) error {
+	entries, err := b.DeadLetters.List()
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		msg.Respond("There are no dead letters")
+		return nil
+	}
+
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = fmt.Sprintf("%s: %s failed for %s (%d attempts)", entry.ID, entry.Handler, entry.EventType, entry.Attempts)
+	}
+	msg.Respond(strings.Join(lines, "\n"))
+	return nil
+}
+
+func (b *ExampleBot) ShowDeadLetter(msg message.Message) error {
+	id := strings.TrimSpace(msg.Matches[0])
+	entry, ok, err := b.DeadLetters.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		msg.Respond("Could not find dead letter %q", id)
+		return nil
+	}
+
+	msg.Respond("%s at %s\nhandler: %s\nerror: %s\n%s: %s", entry.ID, entry.Time.Format(time.RFC3339),
+		entry.Handler, entry.Error, entry.EventType, entry.Payload)
+	return nil
+}
+
+func (b *ExampleBot) RetryDeadLetter(msg message.Message) error {
+	id := strings.TrimSpace(msg.Matches[0])
+	err := b.DeadLetters.Retry(msg.Context, b.Brain, id)
+	if err != nil {
+		msg.Respond("Retry of %q failed: %v", id, err)
+		return nil
+	}
+
+	msg.Respond("Successfully retried %q", id)
+	return nil
+}
+
+func (b *ExampleBot) PurgeDeadLetters(msg message.Message) error {
+	n, err := b.DeadLetters.Purge()
+	if err != nil {
+		return err
+	}
+
+	msg.Respond("Purged %d dead letters", n)
+	return nil
+}
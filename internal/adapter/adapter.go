@@ -2,6 +2,7 @@ package adapter
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -18,6 +19,20 @@ type Adapter interface {
 	Close() error
 }
 
+// A Pinger is an Adapter that can report whether its connection is up.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping returns an error if the connection of the adapter is down. Adapters
+// that do not implement the Pinger interface are always considered to be up.
+func Ping(ctx context.Context, a Adapter) error {
+	if p, ok := a.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
 type CLIAdapter struct {
 	Prefix  string
 	Input   io.ReadCloser
@@ -40,11 +55,15 @@ func NewCLIAdapter(name string) *CLIAdapter {
 }
 
 // RegisterAt starts the Adapter by reading messages from stdin and emitting
-// a ReceiveMessageEvent for each of them.
+// a ReceiveMessageEvent for each of them. The Adapter is closed automatically
+// when the Brain is shut down.
 func (a *CLIAdapter) RegisterAt(brain *brain.Brain) {
 	brain.RegisterHandler(func(evt events.InitEvent) {
 		_ = a.print(a.Prefix)
 	})
+	brain.RegisterHandler(func(evt events.ShutdownEvent) error {
+		return a.Close()
+	})
 
 	go a.loop(brain)
 }
@@ -145,11 +164,12 @@ func (a *CLIAdapter) Close() error {
 
 func (a *CLIAdapter) print(msg string) error {
 	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	if a.closing == nil {
 		return errors.New("adapter is closed")
 	}
 	_, err := fmt.Fprint(a.Output, msg)
-	a.mu.Unlock()
 
 	return err
 }
@@ -1,6 +1,8 @@
 package adapter
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/bwmarrin/discordgo"
@@ -72,7 +74,13 @@ func (a *DiscordAdapter) handleMessageEvent(msg discordgo.Message, brain *brain.
 	})
 }
 
+// RegisterAt starts emitting a ReceiveMessageEvent for each Discord message.
+// The Adapter is closed automatically when the Brain is shut down.
 func (a *DiscordAdapter) RegisterAt(brain *brain.Brain) {
+	brain.RegisterHandler(func(evt events.ShutdownEvent) error {
+		return a.Close()
+	})
+
 	go a.handleDiscordEvents(brain)
 }
 
@@ -83,8 +91,21 @@ func (a *DiscordAdapter) Send(text, channelID string) error {
 	return err
 }
 
-// Close makes the CLIAdapter stop emitting any new events or printing any output.
-// Calling this function more than once will result in an error.
+// Close closes the websocket connection to Discord so the DiscordAdapter stops
+// receiving any new messages.
 func (a *DiscordAdapter) Close() error {
+	a.logger.Info("Closing Discord session")
+	return a.Client.Close()
+}
+
+// Ping returns an error if the websocket connection to Discord is not ready.
+func (a *DiscordAdapter) Ping(context.Context) error {
+	a.Client.RLock()
+	ready := a.Client.DataReady
+	a.Client.RUnlock()
+
+	if !ready {
+		return errors.New("not connected to Discord")
+	}
 	return nil
 }
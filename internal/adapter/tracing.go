@@ -0,0 +1,51 @@
+package adapter
+
+import (
+	"context"
+
+	"github.com/gillepool/botty/internal/tracing"
+)
+
+// A ContextSender is an Adapter that can send a message on behalf of the
+// operation in the context, e.g. to trace it as part of handling an event.
+type ContextSender interface {
+	SendContext(ctx context.Context, text, channel string) error
+}
+
+// SendContext sends the message via the adapter and passes the context on if
+// the adapter implements the ContextSender interface.
+func SendContext(ctx context.Context, a Adapter, text, channel string) error {
+	if s, ok := a.(ContextSender); ok {
+		return s.SendContext(ctx, text, channel)
+	}
+	return a.Send(text, channel)
+}
+
+// Trace wraps the adapter so that every message it sends is recorded as span.
+// Messages that are sent via SendContext become children of the span in the
+// context, all others start a new trace. A nil Tracer disables tracing.
+func Trace(a Adapter, tracer *tracing.Tracer) Adapter {
+	return &tracedAdapter{Adapter: a, tracer: tracer}
+}
+
+type tracedAdapter struct {
+	Adapter
+	tracer *tracing.Tracer
+}
+
+func (a *tracedAdapter) Send(text, channel string) error {
+	return a.SendContext(context.Background(), text, channel)
+}
+
+func (a *tracedAdapter) SendContext(ctx context.Context, text, channel string) error {
+	ctx, span := a.tracer.Start(ctx, "adapter.send")
+	span.SetAttribute("channel", channel)
+	err := SendContext(ctx, a.Adapter, text, channel)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func (a *tracedAdapter) Ping(ctx context.Context) error {
+	return Ping(ctx, a.Adapter)
+}
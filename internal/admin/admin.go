@@ -0,0 +1,178 @@
+// Package admin implements an HTTP server with liveness and readiness probes
+// for the bot process, e.g. to run it in Kubernetes.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gillepool/botty/internal/brain"
+)
+
+// Status values of a component.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// A Check returns an error if a component is not ready.
+type Check func(ctx context.Context) error
+
+// A Server serves /healthz and /readyz. It reports the bot as healthy as long
+// as Brain.HandleEvents is looping and as ready if all readiness checks pass.
+type Server struct {
+	brain        *brain.Brain
+	maxBusy      time.Duration
+	checkTimeout time.Duration
+
+	mu     sync.RWMutex
+	checks map[string]Check
+}
+
+// A Report is the JSON body of the responses.
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+// A Component describes the status of a single part of the bot.
+type Component struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// NewServer creates a Server for the given Brain. The Brain is reported as
+// unhealthy if a single event is handled for longer than maxBusy, either by
+// Brain.HandleEvents itself or by one of its workers.
+func NewServer(b *brain.Brain, maxBusy time.Duration) *Server {
+	return &Server{
+		brain:        b,
+		maxBusy:      maxBusy,
+		checkTimeout: 5 * time.Second,
+		checks:       map[string]Check{},
+	}
+}
+
+// AddReadinessCheck adds a check that must pass for the bot to be ready. A
+// check with the same name is replaced.
+func (s *Server) AddReadinessCheck(name string, check Check) {
+	s.mu.Lock()
+	s.checks[name] = check
+	s.mu.Unlock()
+}
+
+// ServeHTTP serves /healthz and /readyz.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		s.write(w, s.Health())
+	case "/readyz":
+		s.write(w, s.Readiness(r.Context()))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Health reports whether Brain.HandleEvents is looping.
+func (s *Server) Health() Report {
+	return newReport(map[string]Component{"brain": s.brainComponent()})
+}
+
+// Readiness reports whether the Brain and all components of the readiness
+// checks are up. All checks run concurrently and must finish within five
+// seconds.
+func (s *Server) Readiness(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, s.checkTimeout)
+	defer cancel()
+
+	s.mu.RLock()
+	checks := make(map[string]Check, len(s.checks))
+	for name, check := range s.checks {
+		checks[name] = check
+	}
+	s.mu.RUnlock()
+
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		components = map[string]Component{"brain": s.brainComponent()}
+	)
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			c := runCheck(ctx, check)
+			mu.Lock()
+			components[name] = c
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	return newReport(components)
+}
+
+func (s *Server) brainComponent() Component {
+	status := s.brain.Status()
+	details := map[string]interface{}{
+		"running":     status.Running,
+		"queue_depth": status.QueueDepth,
+		"busy":        status.Busy.String(),
+		"leaked":      status.Leaked,
+	}
+
+	switch {
+	case !status.Running:
+		return Component{Status: StatusDown, Error: "brain is not handling events", Details: details}
+	case s.maxBusy > 0 && status.Busy > s.maxBusy:
+		return Component{Status: StatusDown, Error: fmt.Sprintf("brain is busy with a single event for %s", status.Busy), Details: details}
+	default:
+		return Component{Status: StatusUp, Details: details}
+	}
+}
+
+// runCheck executes the check but stops waiting for it when the context is
+// done, because not all backends support cancellation.
+func runCheck(ctx context.Context, check Check) Component {
+	result := make(chan error, 1)
+	go func() {
+		result <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return Component{Status: StatusDown, Error: err.Error()}
+	}
+	return Component{Status: StatusUp}
+}
+
+func newReport(components map[string]Component) Report {
+	report := Report{Status: StatusUp, Components: components}
+	for _, c := range components {
+		if c.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+
+	return report
+}
+
+func (s *Server) write(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != StatusUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func get(t *testing.T, s *Server, path string) (int, Report) {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+	var report Report
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	return rec.Code, report
+}
+
+func TestHealthz(t *testing.T) {
+	b := brain.NewBrain(zaptest.NewLogger(t))
+	s := NewServer(b, time.Minute)
+
+	code, report := get(t, s, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusDown, report.Components["brain"].Status)
+	assert.Equal(t, "brain is not handling events", report.Components["brain"].Error)
+
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents()
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return b.Status().Running }, time.Second, time.Millisecond)
+
+	code, report = get(t, s, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusUp, report.Status)
+	assert.Equal(t, true, report.Components["brain"].Details.(map[string]interface{})["running"])
+
+	require.NoError(t, b.Shutdown(context.Background()))
+	<-done
+}
+
+func TestReadyz(t *testing.T) {
+	b := brain.NewBrain(zaptest.NewLogger(t))
+	go b.HandleEvents()
+	defer b.Shutdown(context.Background())
+	require.Eventually(t, func() bool { return b.Status().Running }, time.Second, time.Millisecond)
+
+	s := NewServer(b, time.Minute)
+	s.checkTimeout = 10 * time.Millisecond
+	s.AddReadinessCheck("memory", func(context.Context) error { return nil })
+
+	code, report := get(t, s, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusUp, report.Components["memory"].Status)
+
+	s.AddReadinessCheck("adapter", func(context.Context) error { return errors.New("not connected") })
+	s.AddReadinessCheck("slow", func(context.Context) error { select {} })
+
+	code, report = get(t, s, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Equal(t, StatusUp, report.Components["brain"].Status)
+	assert.Equal(t, StatusUp, report.Components["memory"].Status)
+	assert.Equal(t, Component{Status: StatusDown, Error: "not connected"}, report.Components["adapter"])
+	assert.Equal(t, Component{Status: StatusDown, Error: context.DeadlineExceeded.Error()}, report.Components["slow"])
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -5,66 +5,207 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/gillepool/botty/internal/events"
+	"github.com/gillepool/botty/internal/tracing"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
 type Brain struct {
-	logger *zap.Logger
-
-	eventsInput chan Event // input for any new events, the Brain ensures that callers never block when writing to it
-	eventsLoop  chan Event // used in Brain.HandleEvents() to actually process the events
-	shutdown    chan shutdownRequest
-
-	mu             sync.RWMutex // mu protects concurrent access to the handlers
-	handlers       map[reflect.Type][]eventHandler
-	handlerTimeout time.Duration // zero means no timeout, defaults to one minute
+	logger    *zap.Logger
+	clock     clock.Clock
+	metrics   MetricsSink
+	errorHook ErrorHook
+	tracer    *tracing.Tracer
+
+	eventsInput chan emitRequest // input for any new events, callers only block if the queue is full (see OverflowBlock)
+	eventsTry   chan emitRequest // input for Brain.TryEmit, which is never blocked by the consumer
+	eventsLoop  chan Event       // used in Brain.HandleEvents() to actually process the events
+	stopInput   chan struct{}    // closed by Brain.Shutdown() to stop accepting new events
+	stopped     chan struct{}    // closed when Brain.HandleEvents() returns
+	eventDone   chan struct{}    // signals the queue that a passed on event was handled (see Brain.passedOnDone)
+
+	mu             sync.RWMutex                          // mu protects concurrent access to the handlers and settings
+	handlers       map[reflect.Type][]*registeredHandler // handlers for a concrete event type or an interface
+	predicates     []*registeredHandler                  // handlers that decide for each event if they match
+	topics         map[string][]*registeredHandler       // handlers for all events of a topic (see TopicEvent)
+	cacheMu        sync.Mutex                            // protects the handlerCache
+	handlerCache   map[reflect.Type][]*registeredHandler // the sorted handlers for each event type
+	handlerSeq     uint64                                // incremented for each registered handler to keep the registration order
+	middleware     []Middleware
+	workers        int          // number of workers that handle events concurrently (see SetConcurrency)
+	eventKey       EventKeyFunc // determines which events must be handled in order
+	queueCapacity  int          // zero means the queue of events is unbounded
+	overflow       OverflowPolicy
+	deadLetters    DeadLetterQueue
+	journal        Journal
+	cancelEvents   context.CancelFunc // cancels the context of all handlers if the shutdown deadline expires
+	handlerTimeout time.Duration      // zero means no timeout, defaults to one minute
+
+	ignoredCancellationDelay time.Duration // warn about abandoned handlers that still run after this delay
+	busy                     busyTracker   // start times of the events that are currently handled
 
 	RegistrationErrs []error // any errors that occurred during setup (e.g. in Bot.RegisterHandler)
 	handlingEvents   int32   // accessed atomically (non-zero means the event handler was started)
 	closed           int32   // accessed atomically (non-zero means the brain was shutdown already)
+	queueDepth       int64   // accessed atomically (number of events waiting in the queue)
+	passedOn         int64   // accessed atomically (number of events passed on by the queue that are not handled yet)
+	droppedEvents    uint64  // accessed atomically (number of events that were discarded due to overflow)
+	leakedHandlers   int64   // accessed atomically (number of abandoned handlers that are still running)
 }
 
+// An Event is passed through the Brain to all handlers of the type of its Data.
+// The Callbacks are executed after all handlers ran and they receive the Event
+// including the outcome of the handlers.
 type Event struct {
 	Data       interface{}
 	Callbacks  []func(Event)
 	AbortEarly bool
-}
 
-// The shutdownRequest type is used when signaling shutdown information between
-// Brain.Shutdown() and the Brain.HandleEvents loop.
-type shutdownRequest struct {
-	ctx      context.Context
-	callback chan bool
+	Handled bool          // true if a handler called FinishEventContent or Reply
+	Results []interface{} // all values that handlers passed to Reply
+	Err     error         // the combined errors of all handlers
 }
 
 // An eventHandler is a function that takes a context and the reflected value
 // of a concrete event type.
 type eventHandler func(context.Context, reflect.Value) error
 
+// HandlerOptions configure how an event handler that is registered via
+// Brain.RegisterHandlerWithOptions is executed.
+//
+// All handlers that match an event, regardless of whether they were registered
+// for the concrete event type or for an interface it implements, are executed
+// in one sequence. Handlers with a higher Priority run first and handlers with
+// the same Priority run in the order in which they were registered. If one of
+// the handlers calls FinishEventContent, all handlers after it in this order
+// are skipped.
+type HandlerOptions struct {
+	Priority int          // higher values run first, defaults to zero
+	Name     string       // used in logs, defaults to the name of the handler function
+	Retry    *RetryPolicy // if set, failed executions of the handler are retried
+	Group    string       // allows removing multiple handlers at once (see Brain.UnregisterGroup)
+
+	// Timeout limits how long the handler may run including all retries.
+	// Zero means the timeout of the Brain is used (see SetHandlerTimeout)
+	// and NoTimeout disables the timeout for this handler.
+	Timeout time.Duration
+}
+
+// A Middleware wraps the execution of every event handler. It can inspect or
+// replace the event before passing it on to next, or it can return without
+// calling next at all to prevent the handler from being executed. Any error it
+// returns is treated like an error of the handler itself.
+type Middleware func(ctx context.Context, evt Event, next NextFunc) error
+
+// A NextFunc executes the remaining middleware and finally the event handler.
+type NextFunc func(ctx context.Context, evt Event) error
+
+// A registeredHandler is an eventHandler together with the information that is
+// required to execute it in a stable order.
+type registeredHandler struct {
+	fun       eventHandler
+	eventType reflect.Type
+	name      string
+	group     string
+	kind      subscriptionKind
+	topic     string                 // only set for topic subscriptions
+	predicate func(interface{}) bool // only set for predicate subscriptions
+	priority  int
+	seq       uint64
+	retry     *RetryPolicy
+	timeout   time.Duration
+	removed   int32 // accessed atomically (non-zero means the handler was unregistered)
+}
+
+// FinishEventContent stops the execution of all remaining handlers of the event
+// that is currently being handled.
 func FinishEventContent(ctx context.Context) {
-	evt, _ := ctx.Value(ctxKeyEvent).(*Event)
-	if evt != nil {
-		evt.AbortEarly = true
+	if state := eventStateOf(ctx); state != nil {
+		state.update(func(evt *Event) {
+			evt.AbortEarly = true
+			evt.Handled = true
+		})
 	}
 }
 
-func NewBrain(logger *zap.Logger) *Brain {
-	if logger == nil {
-		logger = zap.NewNop()
+// The eventState is shared with the handlers of an event via their context,
+// so they can change the event with Reply and FinishEventContent. Abandoned
+// handlers may call these functions while the Brain already moved on, so all
+// access is synchronized and changes are ignored once the event is finished.
+type eventState struct {
+	mu       sync.Mutex
+	event    Event
+	finished bool
+}
+
+func eventStateOf(ctx context.Context) *eventState {
+	state, _ := ctx.Value(ctxKeyEvent).(*eventState)
+	return state
+}
+
+// update changes the event unless it is finished already.
+func (s *eventState) update(fn func(evt *Event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.finished {
+		fn(&s.event)
 	}
+}
+
+// snapshot returns the event in its current state.
+func (s *eventState) snapshot() Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.event
+}
+
+// finish returns the final event. Later changes by abandoned handlers are
+// ignored, so the event can be passed to the callbacks.
+func (s *eventState) finish() Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = true
+	return s.event
+}
+
+// NewBrain creates a Brain that uses the given logger. It is equivalent to
+// calling New with the WithLogger option.
+func NewBrain(logger *zap.Logger) *Brain {
+	return New(WithLogger(logger))
+}
 
+// New creates a Brain that is configured by the given options. Without any
+// options the Brain logs nothing, handles one event at a time, has an
+// unbounded event queue and stops handlers after one minute.
+func New(opts ...Option) *Brain {
 	b := &Brain{
-		logger:         logger,
-		eventsInput:    make(chan Event),
+		logger:         zap.NewNop(),
+		clock:          clock.New(),
+		metrics:        nopMetrics{},
+		eventsInput:    make(chan emitRequest),
+		eventsTry:      make(chan emitRequest),
 		eventsLoop:     make(chan Event),
-		shutdown:       make(chan shutdownRequest),
-		handlers:       make(map[reflect.Type][]eventHandler),
+		stopInput:      make(chan struct{}),
+		stopped:        make(chan struct{}),
+		eventDone:      make(chan struct{}, 1),
+		handlers:       make(map[reflect.Type][]*registeredHandler),
+		topics:         make(map[string][]*registeredHandler),
+		handlerCache:   make(map[reflect.Type][]*registeredHandler),
 		handlerTimeout: time.Minute,
+
+		ignoredCancellationDelay: ignoredCancellationDelay,
+		eventKey:                 DefaultEventKey,
+	}
+
+	for _, opt := range opts {
+		opt(b)
 	}
 
 	b.consumeEvents()
@@ -102,58 +243,160 @@ func (b *Brain) consumeEvents() {
 		return queue[0]
 	}
 
+	inChan := func() chan emitRequest {
+		capacity, policy := b.queueSettings()
+		if policy == OverflowBlock && capacity > 0 && b.pendingEvents(queue) >= capacity {
+			// Block any callers of Brain.Emit until there is space again.
+			return nil
+		}
+		return b.eventsInput
+	}
+
 	go func() {
 		for {
 			select {
-			case event, ok := <-b.eventsInput:
-				if !ok {
-					for _, event := range queue {
-						b.eventsLoop <- event
-					}
-					close(b.eventsLoop)
-					return
+			case <-b.stopInput:
+				// Brain.Shutdown was called so we pass on all remaining events
+				// and signal that no more events will follow.
+				for len(queue) > 0 {
+					b.eventsLoop <- queue[0]
+					atomic.AddInt64(&b.passedOn, 1)
+					queue = queue[1:]
+					b.setQueueDepth(len(queue))
 				}
-				queue = append(queue, event)
+				close(b.eventsLoop)
+				return
+			case req := <-inChan():
+				queue = b.enqueue(queue, req)
+			case req := <-b.eventsTry:
+				queue = b.enqueue(queue, req)
 			case outChan() <- nextEvt():
+				atomic.AddInt64(&b.passedOn, 1)
 				queue = queue[1:]
+				b.setQueueDepth(len(queue))
+			case <-b.eventDone:
+				// There may be space in the queue again.
+				b.setQueueDepth(len(queue))
 			}
 		}
 	}()
 }
 
-func (b *Brain) RegisterHandler(fun interface{}) {
-	err := b.registerHandler(fun)
+// RegisterHandler registers the given function as handler for the event type
+// of its last argument. It is equivalent to calling RegisterHandlerWithOptions
+// with the zero HandlerOptions.
+func (b *Brain) RegisterHandler(fun interface{}) *Registration {
+	return b.RegisterHandlerWithOptions(fun, HandlerOptions{})
+}
+
+// RegisterHandlerWithOptions registers the given function as handler for the
+// event type of its last argument. Any error is added to the RegistrationErrs.
+// The returned Registration can be used to remove or replace the handler later.
+func (b *Brain) RegisterHandlerWithOptions(fun interface{}, opts HandlerOptions) *Registration {
+	handler, err := newRegisteredHandler(fun, opts)
 	if err != nil {
 		b.RegistrationErrs = append(b.RegistrationErrs, err)
+		return &Registration{brain: b}
 	}
+
+	return b.addHandler(handler)
 }
 
-func (b *Brain) registerHandler(fun interface{}) error {
+func newRegisteredHandler(fun interface{}, opts HandlerOptions) (*registeredHandler, error) {
+	if fun == nil {
+		return nil, errors.New("Event handler is not a function")
+	}
+
 	handler := reflect.ValueOf(fun)
 	handlerType := handler.Type()
 	if handlerType.Kind() != reflect.Func {
-		return errors.New("Event handler is not a function")
+		return nil, errors.New("Event handler is not a function")
 	}
 
 	eventType, withContext, err := checkHandlerParams(handlerType)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	returnsErr, err := checkHandlerReturnValues(handlerType)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	name := opts.Name
+	if name == "" {
+		name = runtime.FuncForPC(handler.Pointer()).Name()
 	}
-	handlerFun := newHandlerFunc(handler, withContext, returnsErr)
 
+	return &registeredHandler{
+		fun:       newHandlerFunc(handler, withContext, returnsErr),
+		eventType: eventType,
+		name:      name,
+		group:     opts.Group,
+		priority:  opts.Priority,
+		retry:     opts.Retry,
+		timeout:   opts.Timeout,
+	}, nil
+}
+
+// Use adds middleware that wraps the execution of every event handler. The
+// middleware is executed in the order in which it was added, i.e. the first
+// middleware is the outermost one.
+func (b *Brain) Use(middleware ...Middleware) {
 	b.mu.Lock()
-	b.handlers[eventType] = append(b.handlers[eventType], handlerFun)
+	b.middleware = append(b.middleware, middleware...)
 	b.mu.Unlock()
-
-	return nil
 }
 
+// Emit queues the event to be handled by all matching handlers. The callbacks
+// are executed after all handlers are done. If the event queue is full, the
+// behavior depends on the OverflowPolicy (see SetQueueCapacity). Events that
+// are discarded by the OverflowPolicy are passed to the callbacks right away
+// with ErrEventDropped or, for OverflowReject, ErrQueueFull as their Err.
+// After Brain.Shutdown was called, all new events are discarded.
 func (b *Brain) Emit(event interface{}, callbacks ...func(Event)) {
-	b.eventsInput <- Event{Data: event, Callbacks: callbacks}
+	err := b.emit(event, callbacks)
+	if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrEventDropped) {
+		b.discardEvent(Event{Data: event, Callbacks: callbacks}, err)
+	}
+}
+
+// emit queues the event. It returns ErrEventDropped or ErrQueueFull if the
+// event was discarded by the OverflowPolicy and ErrShutdown if the Brain was
+// shut down.
+func (b *Brain) emit(event interface{}, callbacks []func(Event)) error {
+	req := emitRequest{evt: Event{Data: event, Callbacks: callbacks}, result: make(chan error, 1)}
+
+	select {
+	case b.eventsInput <- req:
+		if err := <-req.result; err != nil {
+			return err
+		}
+		b.metrics.EventEmitted(eventType(event))
+		return nil
+	case <-b.stopInput:
+		b.logger.Warn("Discarding event because the brain was shut down", zap.String("type", fmt.Sprintf("%T", event)))
+		return ErrShutdown
+	}
+}
+
+// TryEmit is like Emit but it never blocks. It returns ErrQueueFull if the
+// event was not queued because the event queue is full and ErrShutdown if
+// Brain.Shutdown was called already. With OverflowDropNewest it returns
+// ErrEventDropped, which is also passed to the callbacks.
+func (b *Brain) TryEmit(event interface{}, callbacks ...func(Event)) error {
+	result := make(chan error, 1)
+	select {
+	case b.eventsTry <- emitRequest{evt: Event{Data: event, Callbacks: callbacks}, result: result, try: true}:
+		err := <-result
+		switch {
+		case err == nil:
+			b.metrics.EventEmitted(eventType(event))
+		case errors.Is(err, ErrEventDropped):
+			b.discardEvent(Event{Data: event, Callbacks: callbacks}, err)
+		}
+		return err
+	case <-b.stopInput:
+		return ErrShutdown
+	}
 }
 
 func checkHandlerParams(handlerFunc reflect.Type) (eventType reflect.Type, withContext bool, err error) {
@@ -226,99 +469,173 @@ func newHandlerFunc(handler reflect.Value, withContext, returnsErr bool) eventHa
 	}
 }
 
+// HandleEvents emits the InitEvent and then handles all emitted events until
+// Brain.Shutdown is called. It returns after the ShutdownEvent was handled.
 func (b *Brain) HandleEvents() {
-	if b.isClosed() {
+	b.mu.Lock()
+	if b.isClosed() || b.isHandlingEvents() {
+		b.mu.Unlock()
 		return
 	}
 
-	ctx := context.Background()
-	var shutdown shutdownRequest // set when Brain.Shutdown() is called
+	// The context is canceled if the deadline of the context that was passed
+	// to Brain.Shutdown() expires before all events are handled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	atomic.StoreInt32(&b.handlingEvents, 1)
-	b.handleEvent(ctx, Event{Data: events.InitEvent{}})
+	b.cancelEvents = cancel
+	b.mu.Unlock()
 
-	for {
-		select {
-		case evt, ok := <-b.eventsLoop:
-			if !ok {
+	b.handleEvent(ctx, Event{Data: events.InitEvent{}})
 
-				b.handleEvent(ctx, Event{Data: events.ShutdownEvent{}})
-				shutdown.callback <- true
-				return
-			}
+	b.mu.RLock()
+	var workers *eventWorkers
+	if b.workers > 1 {
+		workers = b.startWorkers(b.workers, b.eventKey)
+	}
+	b.mu.RUnlock()
+
+	// The loop ends when Brain.Shutdown() was called and all remaining events
+	// were passed on.
+	for evt := range b.eventsLoop {
+		if workers != nil {
+			// The event still counts against the queue capacity until a
+			// worker handled it.
+			workers.dispatch(ctx, evt)
+		} else {
+			b.passedOnDone()
 			b.handleEvent(ctx, evt)
-
-		case shutdown = <-b.shutdown:
-			ctx = shutdown.ctx
-			close(b.eventsInput)
-			atomic.StoreInt32(&b.handlingEvents, 0)
 		}
 	}
+
+	if workers != nil {
+		workers.stop()
+	}
+	atomic.StoreInt32(&b.handlingEvents, 0)
+
+	// The ShutdownEvent is always handled, even if the deadline expired, so
+	// adapters and other resources can be closed.
+	b.handleEvent(context.Background(), Event{Data: events.ShutdownEvent{}})
+	close(b.stopped)
 }
 
 type ctxKey string
 
-const ctxKeyEvent ctxKey = "event"
+const (
+	ctxKeyEvent   ctxKey = "event"
+	ctxKeyHandler ctxKey = "handler"
+)
+
+// HandlerName returns the name of the event handler that is executed with the
+// given context, or an empty string if the context does not belong to a handler.
+// This is mainly useful to identify the handler from within a Middleware.
+func HandlerName(ctx context.Context) string {
+	name, _ := ctx.Value(ctxKeyHandler).(string)
+	return name
+}
 
 func (b *Brain) handleEvent(ctx context.Context, event Event) {
-	eventData := reflect.ValueOf(event.Data)
-	_type := eventData.Type()
-	b.logger.Info("eventData", zap.Any("type", _type))
+	if ctx.Err() != nil {
+		b.logger.Warn("Discarding event because the shutdown deadline expired", zap.String("type", fmt.Sprintf("%T", event.Data)))
+		event.Err = ctx.Err()
+		for _, callback := range event.Callbacks {
+			callback(event)
+		}
+		return
+	}
 
-	handlers := b.determineHandlers(_type)
+	b.logger.Info("eventData", zap.String("type", fmt.Sprintf("%T", event.Data)))
 
-	ctx = context.WithValue(ctx, ctxKeyEvent, &event)
+	id := b.busy.start(b.clock.Now())
+	defer b.busy.done(id)
+
+	handlers, middleware := b.determineHandlers(event.Data)
+
+	ctx, span := b.tracer.Start(ctx, "event "+eventType(event.Data))
+	state := &eventState{event: event}
+	ctx = context.WithValue(ctx, ctxKeyEvent, state)
 
 	for _, handler := range handlers {
-		err := b.executeEventHandler(ctx, handler, eventData)
+		if handler.isRemoved() {
+			// The handler was unregistered while this event was handled.
+			continue
+		}
+
+		handlerCtx, handlerSpan := tracing.Start(ctx, "handler "+handler.name)
+		start := b.clock.Now()
+		err := b.runHandler(handlerCtx, middleware, handler, state.snapshot())
+		b.metrics.HandlerExecuted(eventType(event.Data), handler.name, b.clock.Since(start), err)
+		handlerSpan.SetError(err)
+		handlerSpan.End()
 		if err != nil {
-			b.logger.Error("Event handler failed", zap.Error(err))
+			b.logger.Error("Event handler failed", zap.String("handler", handler.name), zap.Error(err))
+			failed := state.snapshot()
+			b.recordFailure(failed, handler.name, err)
+			if b.errorHook != nil {
+				b.errorHook(failed, handler.name, err)
+			}
+			state.update(func(evt *Event) {
+				evt.Err = multierr.Append(evt.Err, fmt.Errorf("%s: %w", handler.name, err))
+			})
 		}
 
-		if event.AbortEarly {
+		if state.snapshot().AbortEarly {
 			break
 		}
 	}
 
+	event = state.finish()
+	b.metrics.EventHandled(eventType(event.Data))
+	span.SetError(event.Err)
+	span.End()
+
 	for _, callback := range event.Callbacks {
 		callback(event)
 	}
 }
 
-func (b *Brain) executeEventHandler(ctx context.Context, handler eventHandler, event reflect.Value) error {
-	if b.handlerTimeout > 0 {
-		var cancel func()
-		ctx, cancel = context.WithTimeout(ctx, b.handlerTimeout)
-		defer cancel()
-	}
+// runHandler executes the given handler wrapped in all middleware.
+func (b *Brain) runHandler(ctx context.Context, middleware []Middleware, handler *registeredHandler, event Event) error {
+	ctx = context.WithValue(ctx, ctxKeyHandler, handler.name)
 
-	done := make(chan error)
-	go func() {
-		done <- handler(ctx, event)
-	}()
+	next := func(ctx context.Context, evt Event) error {
+		eventData := reflect.ValueOf(evt.Data)
+		if !eventData.IsValid() || !eventData.Type().AssignableTo(handler.eventType) {
+			return fmt.Errorf("middleware passed event of type %T but handler expects %s", evt.Data, handler.eventType)
+		}
+		return b.executeEventHandler(ctx, handler, eventData)
+	}
 
-	select {
-	case err := <-done:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
+	for i := len(middleware) - 1; i >= 0; i-- {
+		mw, inner := middleware[i], next
+		next = func(ctx context.Context, evt Event) error {
+			return mw(ctx, evt, inner)
+		}
 	}
-}
 
-func (b *Brain) determineHandlers(eventType reflect.Type) []eventHandler {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	return next(ctx, event)
+}
 
-	var handlers []eventHandler
-	for handlerType, hh := range b.handlers {
-		if handlerType == eventType {
-			handlers = append(handlers, hh...)
-		}
+// executeEventHandler executes the handler including all retries within the
+// handler timeout.
+func (b *Brain) executeEventHandler(ctx context.Context, handler *registeredHandler, event reflect.Value) error {
+	if timeout := b.timeoutOf(handler); timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-		if handlerType.Kind() == reflect.Interface && eventType.Implements(handlerType) {
-			handlers = append(handlers, hh...)
-		}
+	call := func() error {
+		return b.callEventHandler(ctx, handler, event)
 	}
 
-	return handlers
+	return handler.retry.run(ctx, b.clock, call, func(attempt int, wait time.Duration, err error) {
+		b.logger.Warn("Retrying event handler",
+			zap.String("handler", handler.name),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", wait),
+			zap.Error(err),
+		)
+	})
 }
@@ -0,0 +1,820 @@
+package brain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/gillepool/botty/internal/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type testEvent struct{ Text string }
+
+func (testEvent) Describe() string { return "test" }
+
+type describer interface{ Describe() string }
+
+func TestBrainHandlerPriorities(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var calls []string
+	b.RegisterHandlerWithOptions(func(evt testEvent) { calls = append(calls, "low") }, HandlerOptions{Priority: -1})
+	b.RegisterHandler(func(evt testEvent) { calls = append(calls, "default-1") })
+	b.RegisterHandler(func(evt describer) { calls = append(calls, "default-2") })
+	b.RegisterHandlerWithOptions(func(evt describer) { calls = append(calls, "high") }, HandlerOptions{Priority: 10})
+	b.RegisterHandler(func(evt testEvent) { calls = append(calls, "default-3") })
+	assert.Empty(t, b.RegistrationErrs)
+
+	for i := 0; i < 10; i++ {
+		calls = nil
+		b.handleEvent(context.Background(), Event{Data: testEvent{}})
+		assert.Equal(t, []string{"high", "default-1", "default-2", "default-3", "low"}, calls)
+	}
+}
+
+func TestBrainFinishEventContentSkipsLowerPriorities(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var calls []string
+	b.RegisterHandlerWithOptions(func(evt events.ReceiveMessageEvent) {
+		calls = append(calls, "fallback")
+	}, HandlerOptions{Priority: -100, Name: "fallback"})
+	b.RegisterHandlerWithOptions(func(ctx context.Context, evt events.ReceiveMessageEvent) {
+		calls = append(calls, "command")
+		FinishEventContent(ctx)
+	}, HandlerOptions{Name: "command"})
+
+	b.handleEvent(context.Background(), Event{Data: events.ReceiveMessageEvent{Text: "hello"}})
+	assert.Equal(t, []string{"command"}, calls)
+}
+
+func TestBrainMiddleware(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var calls []string
+	b.Use(func(ctx context.Context, evt Event, next NextFunc) error {
+		calls = append(calls, "outer:"+HandlerName(ctx))
+		return next(ctx, evt)
+	})
+	b.Use(func(ctx context.Context, evt Event, next NextFunc) error {
+		calls = append(calls, "inner")
+		if HandlerName(ctx) == "blocked" {
+			return nil
+		}
+		evt.Data = testEvent{Text: "changed"}
+		return next(ctx, evt)
+	})
+
+	b.RegisterHandlerWithOptions(func(evt testEvent) {
+		calls = append(calls, "handler:"+evt.Text)
+	}, HandlerOptions{Name: "allowed", Priority: 1})
+	b.RegisterHandlerWithOptions(func(evt testEvent) {
+		calls = append(calls, "blocked handler")
+	}, HandlerOptions{Name: "blocked"})
+
+	b.handleEvent(context.Background(), Event{Data: testEvent{Text: "original"}})
+	assert.Equal(t, []string{
+		"outer:allowed", "inner", "handler:changed",
+		"outer:blocked", "inner",
+	}, calls)
+}
+
+func TestBrainMiddlewareRejectsWrongEventType(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	b.Use(func(ctx context.Context, evt Event, next NextFunc) error {
+		evt.Data = events.InitEvent{}
+		return next(ctx, evt)
+	})
+
+	called := false
+	b.RegisterHandler(func(evt testEvent) { called = true })
+	handlers, middleware := b.determineHandlers(testEvent{})
+
+	err := b.runHandler(context.Background(), middleware, handlers[0], Event{Data: testEvent{}})
+	assert.Error(t, err)
+	assert.False(t, called)
+}
+
+func TestBrainWorkersKeepOrderPerKey(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var mu sync.Mutex
+	var order []string
+	fastDone := make(chan struct{})
+	b.RegisterHandler(func(evt events.ReceiveMessageEvent) {
+		if evt.Text == "slow-1" {
+			// block until the event of the other channel was handled
+			<-fastDone
+		}
+
+		mu.Lock()
+		order = append(order, evt.Text)
+		mu.Unlock()
+
+		if evt.Channel == "fast" {
+			close(fastDone)
+		}
+	})
+
+	workers := b.startWorkers(2, DefaultEventKey)
+	ctx := context.Background()
+	workers.dispatch(ctx, Event{Data: events.ReceiveMessageEvent{Channel: "slow", Text: "slow-1"}})
+	workers.dispatch(ctx, Event{Data: events.ReceiveMessageEvent{Channel: "slow", Text: "slow-2"}})
+	workers.dispatch(ctx, Event{Data: events.ReceiveMessageEvent{Channel: "fast", Text: "fast"}})
+	workers.stop()
+
+	assert.Equal(t, []string{"fast", "slow-1", "slow-2"}, order)
+}
+
+func TestBrainWorkersDoNotBlockOnSlowKey(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	b.SetConcurrency(2)
+
+	unblock := make(chan struct{})
+	handled := make(chan string, 1)
+	var slowCount int
+	b.RegisterHandler(func(evt events.ReceiveMessageEvent) {
+		if evt.Channel == "slow" {
+			<-unblock
+			slowCount++ // the events of a channel are never handled concurrently
+			return
+		}
+		handled <- evt.Text
+	})
+
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents()
+		close(done)
+	}()
+
+	// far more events than any buffer of a single worker could hold
+	for i := 0; i < 200; i++ {
+		b.Emit(events.ReceiveMessageEvent{Channel: "slow", Text: fmt.Sprint(i)})
+	}
+	b.Emit(events.ReceiveMessageEvent{Channel: "fast", Text: "fast"})
+
+	select {
+	case text := <-handled:
+		assert.Equal(t, "fast", text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event of another channel was blocked by the slow channel")
+	}
+
+	close(unblock)
+	require.NoError(t, b.Shutdown(context.Background()))
+	<-done
+	assert.Equal(t, 200, slowCount)
+}
+
+func TestBrainWorkersCountAgainstQueueCapacity(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	b.SetConcurrency(2)
+	b.SetQueueCapacity(2, OverflowReject)
+
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	b.RegisterHandler(func(evt events.ReceiveMessageEvent) {
+		started <- struct{}{}
+		<-unblock
+	})
+
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents()
+		close(done)
+	}()
+
+	b.Emit(events.ReceiveMessageEvent{Channel: "slow", Text: "1"})
+	b.Emit(events.ReceiveMessageEvent{Channel: "slow", Text: "2"})
+	<-started
+
+	// one event is handled and the other waits in the queue of its key
+	assert.Equal(t, 2, b.QueueDepth())
+	assert.Equal(t, ErrQueueFull, b.TryEmit(events.ReceiveMessageEvent{Channel: "other"}))
+
+	close(unblock)
+	assert.Eventually(t, func() bool { return b.QueueDepth() == 0 }, 5*time.Second, time.Millisecond)
+	assert.NoError(t, b.TryEmit(events.ReceiveMessageEvent{Channel: "other"}))
+
+	require.NoError(t, b.Shutdown(context.Background()))
+	<-done
+	assert.Equal(t, 0, b.QueueDepth())
+}
+
+func TestBrainQueueCapacity(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	b.SetQueueCapacity(2, OverflowReject)
+
+	// the events are not handled because we never start Brain.HandleEvents
+	assert.NoError(t, b.TryEmit(testEvent{Text: "1"}))
+	assert.NoError(t, b.TryEmit(testEvent{Text: "2"}))
+	assert.Equal(t, ErrQueueFull, b.TryEmit(testEvent{Text: "3"}))
+	assert.Equal(t, 2, b.QueueDepth())
+
+	b.Emit(testEvent{Text: "4"})
+	assert.Equal(t, ErrQueueFull, b.TryEmit(testEvent{Text: "5"})) // also waits until event 4 was processed
+	assert.Equal(t, uint64(1), b.DroppedEvents())
+}
+
+func TestBrainQueueRejectReportsFullQueue(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	b.SetQueueCapacity(1, OverflowReject)
+
+	// the events are not handled because we never start Brain.HandleEvents
+	b.Emit(testEvent{Text: "1"})
+
+	_, err := b.EmitAndWait(context.Background(), testEvent{Text: "2"})
+	assert.Equal(t, ErrQueueFull, err)
+
+	var rejected Event
+	b.Emit(testEvent{Text: "3"}, func(evt Event) {
+		rejected = evt
+	})
+	assert.Equal(t, ErrQueueFull, rejected.Err)
+	assert.Equal(t, testEvent{Text: "3"}, rejected.Data)
+
+	assert.Equal(t, 1, b.QueueDepth())
+	assert.Equal(t, uint64(2), b.DroppedEvents()) // the events of Emit and EmitAndWait
+}
+
+type testJournal []interface{}
+
+func (j *testJournal) Record(event interface{}) error {
+	*j = append(*j, event)
+	return nil
+}
+
+func TestBrainJournalRecordsQueuedEvents(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	journal := new(testJournal)
+	b.SetJournal(journal)
+	b.SetQueueCapacity(1, OverflowDropNewest)
+
+	// the events are not handled because we never start Brain.HandleEvents
+	b.Emit(testEvent{Text: "1"})
+	b.Emit(testEvent{Text: "2"})
+	assert.Equal(t, ErrEventDropped, b.TryEmit(testEvent{Text: "3"}))
+
+	require.NoError(t, b.Shutdown(context.Background()))
+	b.Emit(testEvent{Text: "4"})
+
+	assert.Equal(t, &testJournal{testEvent{Text: "1"}}, journal)
+}
+
+func TestBrainQueueDropOldest(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	b.SetQueueCapacity(2, OverflowDropOldest)
+
+	for _, text := range []string{"1", "2", "3"} {
+		assert.NoError(t, b.TryEmit(testEvent{Text: text}))
+	}
+	assert.Equal(t, 2, b.QueueDepth())
+	assert.Equal(t, uint64(1), b.DroppedEvents())
+
+	assert.Equal(t, testEvent{Text: "2"}, (<-b.eventsLoop).Data)
+	assert.Equal(t, testEvent{Text: "3"}, (<-b.eventsLoop).Data)
+}
+
+func TestBrainQueueReportsDroppedEvents(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	b.SetQueueCapacity(1, OverflowDropOldest)
+
+	// the events are not handled because we never start Brain.HandleEvents
+	dropped := make(chan error, 1)
+	go func() {
+		_, err := b.EmitAndWait(context.Background(), testEvent{Text: "1"})
+		dropped <- err
+	}()
+	assert.Eventually(t, func() bool { return b.QueueDepth() == 1 }, 5*time.Second, time.Millisecond)
+
+	b.Emit(testEvent{Text: "2"})
+	select {
+	case err := <-dropped:
+		assert.Equal(t, ErrEventDropped, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("EmitAndWait did not return after its event was dropped")
+	}
+
+	b.SetQueueCapacity(1, OverflowDropNewest)
+	_, err := b.EmitAndWait(context.Background(), testEvent{Text: "3"})
+	assert.Equal(t, ErrEventDropped, err)
+
+	var rejected Event
+	assert.Equal(t, ErrEventDropped, b.TryEmit(testEvent{Text: "4"}, func(evt Event) {
+		rejected = evt
+	}))
+	assert.Equal(t, ErrEventDropped, rejected.Err)
+	assert.Equal(t, testEvent{Text: "4"}, rejected.Data)
+	assert.Equal(t, uint64(3), b.DroppedEvents())
+}
+
+type failureRecorder []HandlerFailure
+
+func (r *failureRecorder) Add(f HandlerFailure) error {
+	*r = append(*r, f)
+	return nil
+}
+
+func TestBrainRecordsFailedHandlers(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	failures := new(failureRecorder)
+	b.SetDeadLetterQueue(failures)
+
+	b.RegisterHandlerWithOptions(func(evt testEvent) error {
+		return errors.New("failed")
+	}, HandlerOptions{Name: "failing"})
+	b.RegisterHandlerWithOptions(func(evt testEvent) {
+		panic("boom")
+	}, HandlerOptions{Name: "panicking"})
+	b.RegisterHandlerWithOptions(func(evt testEvent) {}, HandlerOptions{Name: "working"})
+
+	b.handleEvent(context.Background(), Event{Data: testEvent{Text: "test"}})
+
+	require.Len(t, *failures, 2)
+	assert.Equal(t, "failing", (*failures)[0].Handler)
+	assert.Equal(t, testEvent{Text: "test"}, (*failures)[0].Data)
+	assert.EqualError(t, (*failures)[0].Err, "failed")
+	assert.Equal(t, "panicking", (*failures)[1].Handler)
+
+	assert.NoError(t, b.Deliver(context.Background(), "working", testEvent{}))
+	assert.ErrorIs(t, b.Deliver(context.Background(), "unknown", testEvent{}), ErrHandlerNotFound)
+	assert.Len(t, *failures, 2)
+}
+
+func TestBrainRetryPolicy(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	errTemporary := errors.New("temporary")
+	errPermanent := errors.New("permanent")
+
+	attempts := map[string]int{}
+	results := map[string][]error{
+		"flaky":     {errTemporary, errTemporary, nil},
+		"permanent": {errPermanent, nil},
+		"exhausted": {errTemporary, errTemporary, errTemporary, nil},
+	}
+
+	policy := &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Jitter:         0.5,
+		Retryable:      func(err error) bool { return err == errTemporary },
+	}
+
+	for name := range results {
+		name := name
+		b.RegisterHandlerWithOptions(func(evt testEvent) error {
+			if evt.Text != name {
+				return nil
+			}
+			err := results[name][attempts[name]]
+			attempts[name]++
+			return err
+		}, HandlerOptions{Name: name, Retry: policy})
+	}
+
+	assert.NoError(t, b.Deliver(context.Background(), "flaky", testEvent{Text: "flaky"}))
+	assert.Equal(t, 3, attempts["flaky"])
+
+	assert.ErrorIs(t, b.Deliver(context.Background(), "permanent", testEvent{Text: "permanent"}), errPermanent)
+	assert.Equal(t, 1, attempts["permanent"])
+
+	assert.ErrorIs(t, b.Deliver(context.Background(), "exhausted", testEvent{Text: "exhausted"}), errTemporary)
+	assert.Equal(t, 3, attempts["exhausted"])
+}
+
+func TestRetryPolicyStopsWhenContextIsDone(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	err := policy.run(ctx, clock.New(), func() error {
+		attempts++
+		return errors.New("failed")
+	}, nil)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestBrainShutdownDrainsQueue(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var handled []string
+	shutdownHandled := false
+	b.RegisterHandler(func(evt testEvent) {
+		time.Sleep(time.Millisecond)
+		handled = append(handled, evt.Text)
+	})
+	b.RegisterHandler(func(evt events.ShutdownEvent) { shutdownHandled = true })
+
+	for _, text := range []string{"1", "2", "3"} {
+		b.Emit(testEvent{Text: text})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents()
+		close(done)
+	}()
+
+	require.Eventually(t, b.isHandlingEvents, time.Second, time.Millisecond)
+	assert.NoError(t, b.Shutdown(context.Background()))
+	<-done
+
+	assert.Equal(t, []string{"1", "2", "3"}, handled)
+	assert.True(t, shutdownHandled)
+	assert.Equal(t, ErrShutdown, b.TryEmit(testEvent{}))
+	assert.Equal(t, ErrShutdown, b.Shutdown(context.Background()))
+	b.Emit(testEvent{Text: "ignored"}) // must not block
+}
+
+func TestBrainShutdownWithoutHandleEvents(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	shutdownHandled := false
+	b.RegisterHandler(func(evt events.ShutdownEvent) { shutdownHandled = true })
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := b.EmitAndWait(context.Background(), testEvent{Text: "never handled"})
+		result <- err
+	}()
+	require.Eventually(t, func() bool { return b.QueueDepth() == 1 }, time.Second, time.Millisecond)
+
+	require.NoError(t, b.Shutdown(context.Background()))
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrShutdown, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("EmitAndWait did not return after its event was discarded")
+	}
+	assert.True(t, shutdownHandled)
+	assert.Equal(t, 0, b.QueueDepth())
+}
+
+func TestBrainShutdownDeadline(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var shutdownHandled int32
+	b.RegisterHandler(func(evt events.ShutdownEvent) { atomic.StoreInt32(&shutdownHandled, 1) })
+
+	var mu sync.Mutex
+	var handled []string
+	b.RegisterHandler(func(ctx context.Context, evt testEvent) error {
+		<-ctx.Done()
+		mu.Lock()
+		handled = append(handled, evt.Text)
+		mu.Unlock()
+		return ctx.Err()
+	})
+
+	go b.HandleEvents()
+	require.Eventually(t, b.isHandlingEvents, time.Second, time.Millisecond)
+
+	b.Emit(testEvent{Text: "blocking"})
+	b.Emit(testEvent{Text: "discarded"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, b.Shutdown(ctx), context.DeadlineExceeded)
+
+	// Shutdown waits for the ShutdownEvent even after the deadline expired
+	assert.EqualValues(t, 1, atomic.LoadInt32(&shutdownHandled))
+	assert.False(t, b.isHandlingEvents())
+
+	// the handler was abandoned, so it may finish after Shutdown returned
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 1 && handled[0] == "blocking"
+	}, time.Second, time.Millisecond)
+}
+
+func TestBrainUnregisterHandlers(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var calls []string
+	first := b.RegisterHandler(func(evt testEvent) { calls = append(calls, "first") })
+	b.RegisterHandlerWithOptions(func(evt testEvent) { calls = append(calls, "plugin-1") }, HandlerOptions{Group: "plugin"})
+	b.RegisterHandlerWithOptions(func(evt describer) { calls = append(calls, "plugin-2") }, HandlerOptions{Group: "plugin"})
+	last := b.RegisterHandler(func(evt testEvent) { calls = append(calls, "last") })
+
+	assert.True(t, first.Unregister())
+	assert.False(t, first.Unregister())
+	b.handleEvent(context.Background(), Event{Data: testEvent{}})
+	assert.Equal(t, []string{"plugin-1", "plugin-2", "last"}, calls)
+
+	calls = nil
+	assert.Equal(t, 0, b.UnregisterGroup(""))
+	assert.Equal(t, 2, b.UnregisterGroup("plugin"))
+	b.handleEvent(context.Background(), Event{Data: testEvent{}})
+	assert.Equal(t, []string{"last"}, calls)
+
+	calls = nil
+	assert.NoError(t, last.Replace(func(evt testEvent) { calls = append(calls, "replaced") }))
+	assert.Error(t, last.Replace(func(evt events.InitEvent) {}))
+	b.handleEvent(context.Background(), Event{Data: testEvent{}})
+	assert.Equal(t, []string{"replaced"}, calls)
+}
+
+func TestBrainUnregisterWhileHandling(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var second *Registration
+	var calls []string
+	b.RegisterHandler(func(evt testEvent) {
+		calls = append(calls, "first")
+		second.Unregister()
+	})
+	second = b.RegisterHandler(func(evt testEvent) { calls = append(calls, "second") })
+
+	b.handleEvent(context.Background(), Event{Data: testEvent{}})
+	assert.Equal(t, []string{"first"}, calls)
+}
+
+type onCallQuery struct{ Team string }
+
+func TestBrainEmitAndWait(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+	b.RegisterHandler(func(ctx context.Context, q onCallQuery) {
+		Reply(ctx, "alice@"+q.Team)
+	})
+	b.RegisterHandlerWithOptions(func(q onCallQuery) error {
+		return errors.New("pager service unavailable")
+	}, HandlerOptions{Name: "pager"})
+
+	go b.HandleEvents()
+	defer b.Shutdown(context.Background())
+
+	evt, err := b.EmitAndWait(context.Background(), onCallQuery{Team: "infra"})
+	assert.EqualError(t, err, "pager: pager service unavailable")
+	assert.True(t, evt.Handled)
+
+	var onCall string
+	assert.True(t, evt.Result(&onCall))
+	assert.Equal(t, "alice@infra", onCall)
+
+	var count int
+	assert.False(t, evt.Result(&count))
+
+	evt, err = b.EmitAndWait(context.Background(), testEvent{})
+	assert.NoError(t, err)
+	assert.False(t, evt.Handled)
+	assert.Empty(t, evt.Results)
+}
+
+func TestBrainReplyAfterTimeoutIsIgnored(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	release := make(chan struct{})
+	replied := make(chan struct{})
+	b.RegisterHandlerWithOptions(func(ctx context.Context, evt testEvent) {
+		<-release // ignores the context
+		Reply(ctx, "late")
+		FinishEventContent(ctx)
+		close(replied)
+	}, HandlerOptions{Name: "stubborn", Timeout: 5 * time.Millisecond})
+	b.RegisterHandler(func(ctx context.Context, evt testEvent) {
+		Reply(ctx, "on time")
+	})
+
+	go b.HandleEvents()
+	defer b.Shutdown(context.Background())
+
+	evt, err := b.EmitAndWait(context.Background(), testEvent{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the abandoned handler replies while the callers already use the event
+	close(release)
+	assert.Equal(t, []interface{}{"on time"}, evt.Results)
+	assert.False(t, evt.AbortEarly)
+	<-replied
+}
+
+type moderationEvent struct{ User string }
+
+func (moderationEvent) Topic() string { return "moderation" }
+
+func TestBrainSubscriptions(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var calls []string
+	b.SubscribeAll(func(evt interface{}) {
+		calls = append(calls, fmt.Sprintf("audit %T", evt))
+	}, HandlerOptions{Priority: 100})
+	b.SubscribeFunc(func(evt interface{}) bool {
+		msg, ok := evt.(events.ReceiveMessageEvent)
+		return ok && msg.AuthorID == "admin"
+	}, func(evt events.ReceiveMessageEvent) {
+		calls = append(calls, "admin message")
+	}, HandlerOptions{})
+	b.SubscribeTopic("moderation", func(evt interface{}) {
+		calls = append(calls, "moderation")
+	}, HandlerOptions{Priority: -1})
+	b.RegisterHandler(func(evt moderationEvent) {
+		calls = append(calls, "ban "+evt.User)
+	})
+
+	b.SubscribeAll(func(evt testEvent) {}, HandlerOptions{})
+	b.SubscribeFunc(nil, func(evt interface{}) {}, HandlerOptions{})
+	assert.Len(t, b.RegistrationErrs, 2)
+
+	b.handleEvent(context.Background(), Event{Data: events.ReceiveMessageEvent{AuthorID: "admin"}})
+	b.handleEvent(context.Background(), Event{Data: events.ReceiveMessageEvent{AuthorID: "user"}})
+	b.handleEvent(context.Background(), Event{Data: moderationEvent{User: "troll"}})
+
+	assert.Equal(t, []string{
+		"audit events.ReceiveMessageEvent", "admin message",
+		"audit events.ReceiveMessageEvent",
+		"audit brain.moderationEvent", "ban troll", "moderation",
+	}, calls)
+}
+
+func TestBrainHandlerCacheIsInvalidated(t *testing.T) {
+	b := NewBrain(zaptest.NewLogger(t))
+
+	var calls []string
+	b.RegisterHandler(func(evt testEvent) { calls = append(calls, "first") })
+	b.handleEvent(context.Background(), Event{Data: testEvent{}})
+
+	b.RegisterHandler(func(evt describer) { calls = append(calls, "second") })
+	b.handleEvent(context.Background(), Event{Data: testEvent{}})
+
+	assert.Equal(t, []string{"first", "first", "second"}, calls)
+}
+
+func BenchmarkDetermineHandlers(b *testing.B) {
+	brain := NewBrain(nil)
+	for i := 0; i < 500; i++ {
+		brain.RegisterHandler(func(evt events.ReceiveMessageEvent) {})
+		brain.RegisterHandler(func(evt testEvent) {})
+		brain.RegisterHandler(func(evt describer) {})
+	}
+	brain.SubscribeTopic("moderation", func(evt interface{}) {}, HandlerOptions{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		brain.determineHandlers(testEvent{})
+	}
+}
+
+func TestBrainStatusBusyWithWorkers(t *testing.T) {
+	clk := clock.NewMock()
+	b := New(WithLogger(zaptest.NewLogger(t)), WithClock(clk), WithConcurrency(2))
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	b.RegisterHandler(func(evt events.ReceiveMessageEvent) {
+		if evt.Channel == "stuck" {
+			close(started)
+			<-unblock
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents()
+		close(done)
+	}()
+
+	b.Emit(events.ReceiveMessageEvent{Channel: "stuck"})
+	<-started
+	clk.Add(time.Minute)
+
+	// other events are still handled, but the stuck one keeps the Brain busy
+	_, err := b.EmitAndWait(context.Background(), events.ReceiveMessageEvent{Channel: "other"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, b.Status().Busy)
+
+	close(unblock)
+	assert.Eventually(t, func() bool { return b.Status().Busy == 0 }, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, b.Shutdown(context.Background()))
+	<-done
+}
+
+func TestBrainHandlerTimeouts(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	b := NewBrain(zap.New(core))
+	b.SetHandlerTimeout(time.Hour)
+	b.ignoredCancellationDelay = 10 * time.Millisecond
+
+	release := make(chan struct{})
+	b.RegisterHandlerWithOptions(func(evt testEvent) {
+		<-release // ignores the context
+	}, HandlerOptions{Name: "stubborn", Timeout: 5 * time.Millisecond})
+	b.RegisterHandlerWithOptions(func(ctx context.Context, evt testEvent) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, HandlerOptions{Name: "cooperative", Timeout: 5 * time.Millisecond})
+
+	assert.ErrorIs(t, b.Deliver(context.Background(), "stubborn", testEvent{}), context.DeadlineExceeded)
+	assert.ErrorIs(t, b.Deliver(context.Background(), "cooperative", testEvent{}), context.DeadlineExceeded)
+
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("Event handler ignores the cancellation of its context").Len() == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "stubborn", logs.All()[0].ContextMap()["handler"])
+	assert.Equal(t, int64(1), b.LeakedHandlers())
+
+	close(release)
+	require.Eventually(t, func() bool { return b.LeakedHandlers() == 0 }, time.Second, time.Millisecond)
+}
+
+type metricsRecorder struct {
+	mu       sync.Mutex
+	emitted  []string
+	handled  []string
+	handlers map[string]time.Duration
+	errors   map[string]error
+	depths   []int
+}
+
+func (m *metricsRecorder) EventEmitted(eventType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emitted = append(m.emitted, eventType)
+}
+
+func (m *metricsRecorder) EventHandled(eventType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handled = append(m.handled, eventType)
+}
+
+func (m *metricsRecorder) HandlerExecuted(eventType, handler string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[handler] = duration
+	m.errors[handler] = err
+}
+
+func (m *metricsRecorder) QueueDepthChanged(depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depths = append(m.depths, depth)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	mock := clock.NewMock()
+	metrics := &metricsRecorder{handlers: map[string]time.Duration{}, errors: map[string]error{}}
+	var hooked []string
+
+	b := New(
+		WithLogger(zaptest.NewLogger(t)),
+		WithClock(mock),
+		WithMetrics(metrics),
+		WithErrorHook(func(evt Event, handler string, err error) {
+			hooked = append(hooked, handler+": "+err.Error())
+		}),
+		WithQueueSize(1, OverflowReject),
+		WithHandlerTimeout(time.Hour),
+		WithConcurrency(2),
+	)
+
+	capacity, policy := b.queueSettings()
+	assert.Equal(t, 1, capacity)
+	assert.Equal(t, OverflowReject, policy)
+	assert.Equal(t, time.Hour, b.handlerTimeout)
+	assert.Equal(t, 2, b.workers)
+
+	b.RegisterHandlerWithOptions(func(evt testEvent) {
+		mock.Add(time.Second)
+	}, HandlerOptions{Name: "slow"})
+	b.RegisterHandlerWithOptions(func(evt testEvent) error {
+		return errors.New("failed")
+	}, HandlerOptions{Name: "failing"})
+
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents()
+		close(done)
+	}()
+
+	_, err := b.EmitAndWait(context.Background(), testEvent{})
+	assert.Error(t, err)
+	require.NoError(t, b.Shutdown(context.Background()))
+	<-done
+
+	assert.Equal(t, []string{"failing: failed"}, hooked)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.Equal(t, []string{"brain.testEvent"}, metrics.emitted)
+	assert.Equal(t, []string{"events.InitEvent", "brain.testEvent", "events.ShutdownEvent"}, metrics.handled)
+	assert.Equal(t, time.Second, metrics.handlers["slow"])
+	assert.EqualError(t, metrics.errors["failing"], "failed")
+	assert.Contains(t, metrics.depths, 1)
+}
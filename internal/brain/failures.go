@@ -0,0 +1,90 @@
+package brain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrHandlerNotFound is returned by Brain.Deliver if there is no handler with
+// the requested name for the given event.
+var ErrHandlerNotFound = errors.New("no event handler with this name")
+
+// A HandlerFailure describes an event that could not be delivered to one of its
+// handlers because the handler returned an error, panicked or timed out.
+type HandlerFailure struct {
+	Data    interface{} // corresponds to the Event.Data field
+	Handler string      // the name of the handler (see HandlerOptions)
+	Err     error
+	Time    time.Time
+}
+
+// A DeadLetterQueue records all events that could not be delivered to their
+// handlers, so they can be inspected and retried later.
+type DeadLetterQueue interface {
+	Add(HandlerFailure) error
+}
+
+// SetDeadLetterQueue sets the queue that records all failed handler
+// executions. Passing nil disables recording failures, which is the default.
+func (b *Brain) SetDeadLetterQueue(queue DeadLetterQueue) {
+	b.mu.Lock()
+	b.deadLetters = queue
+	b.mu.Unlock()
+}
+
+func (b *Brain) recordFailure(event Event, handler string, err error) {
+	b.mu.RLock()
+	queue := b.deadLetters
+	b.mu.RUnlock()
+
+	if queue == nil {
+		return
+	}
+
+	failure := HandlerFailure{
+		Data:    event.Data,
+		Handler: handler,
+		Err:     err,
+		Time:    b.clock.Now(),
+	}
+
+	if err := queue.Add(failure); err != nil {
+		b.logger.Error("Failed to add event to dead letter queue", zap.String("handler", handler), zap.Error(err))
+	}
+}
+
+// Deliver synchronously passes the event to all handlers with the given name
+// (see HandlerOptions) and returns the first error. Failures are not recorded
+// in the DeadLetterQueue, which makes this function suitable to retry entries
+// of the queue.
+func (b *Brain) Deliver(ctx context.Context, handlerName string, data interface{}) error {
+	if data == nil {
+		return errors.New("cannot deliver nil event")
+	}
+
+	handlers, middleware := b.determineHandlers(data)
+
+	state := &eventState{event: Event{Data: data}}
+	ctx = context.WithValue(ctx, ctxKeyEvent, state)
+
+	delivered := false
+	for _, handler := range handlers {
+		if handler.name != handlerName || handler.isRemoved() {
+			continue
+		}
+
+		delivered = true
+		if err := b.runHandler(ctx, middleware, handler, state.snapshot()); err != nil {
+			return fmt.Errorf("%s: %w", handlerName, err)
+		}
+	}
+
+	if !delivered {
+		return fmt.Errorf("%w: %q", ErrHandlerNotFound, handlerName)
+	}
+	return nil
+}
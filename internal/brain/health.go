@@ -0,0 +1,73 @@
+package brain
+
+import (
+	"sync"
+	"time"
+)
+
+// A Status describes whether the Brain is handling events.
+type Status struct {
+	Running    bool          `json:"running"`     // true while Brain.HandleEvents is looping
+	QueueDepth int           `json:"queue_depth"` // number of events that are waiting to be handled
+	Busy       time.Duration `json:"busy"`        // how long the oldest event that is currently handled has been running, zero if idle
+	Leaked     int64         `json:"leaked"`      // number of abandoned handlers that are still running
+}
+
+// Status returns the current Status of the Brain. A Brain that is Running but
+// Busy for a long time is most likely stuck in an event handler that does not
+// respect its timeout.
+func (b *Brain) Status() Status {
+	status := Status{
+		Running:    b.isHandlingEvents(),
+		QueueDepth: b.QueueDepth(),
+		Leaked:     b.LeakedHandlers(),
+	}
+
+	if since, ok := b.busy.oldest(); ok {
+		status.Busy = b.clock.Since(since)
+	}
+
+	return status
+}
+
+// The busyTracker keeps the start times of all events that are currently
+// handled, either by Brain.HandleEvents itself or by its workers.
+type busyTracker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	started map[uint64]time.Time
+}
+
+// start records that an event is handled since the given time and returns
+// the ID that must be passed to done.
+func (t *busyTracker) start(now time.Time) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.started == nil {
+		t.started = map[uint64]time.Time{}
+	}
+	t.nextID++
+	t.started[t.nextID] = now
+	return t.nextID
+}
+
+func (t *busyTracker) done(id uint64) {
+	t.mu.Lock()
+	delete(t.started, id)
+	t.mu.Unlock()
+}
+
+// oldest returns the start time of the event that is handled the longest.
+func (t *busyTracker) oldest() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var oldest time.Time
+	for _, started := range t.started {
+		if oldest.IsZero() || started.Before(oldest) {
+			oldest = started
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
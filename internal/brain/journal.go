@@ -0,0 +1,36 @@
+package brain
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// A Journal records every event that is queued by the Brain, e.g. to
+// reproduce incidents by replaying the events later. Events that are discarded
+// because the queue is full or the Brain was shut down are not recorded.
+type Journal interface {
+	Record(event interface{}) error
+}
+
+// SetJournal sets the Journal that records all emitted events. Passing nil
+// disables recording, which is the default.
+func (b *Brain) SetJournal(journal Journal) {
+	b.mu.Lock()
+	b.journal = journal
+	b.mu.Unlock()
+}
+
+func (b *Brain) record(event interface{}) {
+	b.mu.RLock()
+	journal := b.journal
+	b.mu.RUnlock()
+
+	if journal == nil {
+		return
+	}
+
+	if err := journal.Record(event); err != nil {
+		b.logger.Warn("Failed to record event in journal", zap.String("type", fmt.Sprintf("%T", event)), zap.Error(err))
+	}
+}
@@ -0,0 +1,110 @@
+package brain
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/gillepool/botty/internal/tracing"
+	"go.uber.org/zap"
+)
+
+// An Option configures a Brain when it is created via New.
+type Option func(*Brain)
+
+// A MetricsSink receives measurements about the events that pass through the
+// Brain. Implementations must be safe for concurrent use.
+type MetricsSink interface {
+	EventEmitted(eventType string)
+	EventHandled(eventType string)
+	HandlerExecuted(eventType, handler string, duration time.Duration, err error)
+	QueueDepthChanged(depth int)
+}
+
+// An ErrorHook is called whenever an event handler fails, in addition to
+// logging the error and recording it in the DeadLetterQueue.
+type ErrorHook func(evt Event, handler string, err error)
+
+// WithLogger sets the logger of the Brain. By default nothing is logged.
+func WithLogger(logger *zap.Logger) Option {
+	return func(b *Brain) {
+		if logger != nil {
+			b.logger = logger
+		}
+	}
+}
+
+// WithHandlerTimeout sets the default time limit for all handlers (see
+// Brain.SetHandlerTimeout).
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(b *Brain) {
+		b.handlerTimeout = timeout
+	}
+}
+
+// WithQueueSize limits the number of queued events and decides what happens
+// if the limit is reached (see Brain.SetQueueCapacity).
+func WithQueueSize(capacity int, policy OverflowPolicy) Option {
+	return func(b *Brain) {
+		b.queueCapacity = capacity
+		b.overflow = policy
+	}
+}
+
+// WithConcurrency sets the number of workers that handle events in parallel
+// (see Brain.SetConcurrency).
+func WithConcurrency(workers int) Option {
+	return func(b *Brain) {
+		b.workers = workers
+	}
+}
+
+// WithClock replaces the clock that is used to measure handler durations, to
+// wait between retries and to timestamp failures. This is mainly useful in
+// tests to pass a *clock.Mock. Handler timeouts always use the real time.
+func WithClock(c clock.Clock) Option {
+	return func(b *Brain) {
+		if c != nil {
+			b.clock = c
+		}
+	}
+}
+
+// WithMetrics sets the sink that receives measurements about the handled
+// events. By default no metrics are collected.
+func WithMetrics(sink MetricsSink) Option {
+	return func(b *Brain) {
+		if sink != nil {
+			b.metrics = sink
+		}
+	}
+}
+
+// WithErrorHook sets a function that is called whenever an event handler
+// fails.
+func WithErrorHook(hook ErrorHook) Option {
+	return func(b *Brain) {
+		b.errorHook = hook
+	}
+}
+
+// WithTracer sets the tracer that records a span for each event and each of
+// its handlers. The context of the handlers contains the span of the handler,
+// so any spans they start become its children. By default nothing is traced.
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(b *Brain) {
+		b.tracer = tracer
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) EventEmitted(string)                                  {}
+func (nopMetrics) EventHandled(string)                                  {}
+func (nopMetrics) HandlerExecuted(string, string, time.Duration, error) {}
+func (nopMetrics) QueueDepthChanged(int)                                {}
+
+// eventType returns the name under which metrics of the event are reported.
+func eventType(data interface{}) string {
+	return fmt.Sprintf("%T", data)
+}
@@ -0,0 +1,178 @@
+package brain
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// ErrQueueFull is returned by Brain.TryEmit if the event queue has reached its
+// capacity. With OverflowReject it is also returned by Brain.EmitAndWait.
+var ErrQueueFull = errors.New("event queue is full")
+
+// ErrEventDropped is passed to the callbacks of events that were discarded by
+// OverflowDropNewest or OverflowDropOldest. Brain.EmitAndWait and
+// Brain.TryEmit return it if their own event was discarded.
+var ErrEventDropped = errors.New("event was dropped because the event queue is full")
+
+// An OverflowPolicy decides what happens to new events when the event queue of
+// the Brain has reached its capacity.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks Brain.Emit until there is space in the queue.
+	// Brain.TryEmit returns ErrQueueFull instead of blocking.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the new event and passes ErrEventDropped to
+	// its callbacks.
+	OverflowDropNewest
+	// OverflowDropOldest discards the event that waited the longest to make
+	// space for the new event and passes ErrEventDropped to its callbacks.
+	OverflowDropOldest
+	// OverflowReject discards the new event and reports ErrQueueFull to the
+	// caller: Brain.EmitAndWait returns it and Brain.Emit passes it to the
+	// callbacks of the event.
+	OverflowReject
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// An emitRequest is sent from Brain.Emit or Brain.TryEmit to the goroutine
+// that manages the event queue.
+type emitRequest struct {
+	evt    Event
+	result chan error // receives the outcome once the event was queued or discarded
+	try    bool       // the caller handles a full queue itself (see Brain.TryEmit)
+}
+
+// SetQueueCapacity limits the number of events that can wait to be handled.
+// With more than one worker (see SetConcurrency), events that were passed to
+// the workers count against the capacity until they are handled. A capacity
+// of zero or less means the queue is unbounded, which is the default. The
+// policy decides what happens with new events if the queue is full.
+func (b *Brain) SetQueueCapacity(capacity int, policy OverflowPolicy) {
+	b.mu.Lock()
+	b.queueCapacity = capacity
+	b.overflow = policy
+	b.mu.Unlock()
+}
+
+// QueueDepth returns the number of events that are currently waiting to be
+// handled. With more than one worker (see SetConcurrency) this includes the
+// events that were passed to the workers until they are handled.
+func (b *Brain) QueueDepth() int {
+	return int(atomic.LoadInt64(&b.queueDepth) + atomic.LoadInt64(&b.passedOn))
+}
+
+// DroppedEvents returns the number of events that were discarded so far
+// because the event queue was full.
+func (b *Brain) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&b.droppedEvents)
+}
+
+func (b *Brain) setQueueDepth(queued int) {
+	atomic.StoreInt64(&b.queueDepth, int64(queued))
+	b.metrics.QueueDepthChanged(b.QueueDepth())
+}
+
+// pendingEvents returns the number of events that count against the queue
+// capacity: the queued ones and those that were passed on but not handled.
+func (b *Brain) pendingEvents(queue []Event) int {
+	return len(queue) + int(atomic.LoadInt64(&b.passedOn))
+}
+
+// passedOnDone marks an event that was passed on by the queue as handled, or
+// as taken by Brain.HandleEvents if it handles the event itself.
+func (b *Brain) passedOnDone() {
+	atomic.AddInt64(&b.passedOn, -1)
+	select {
+	case b.eventDone <- struct{}{}:
+	default:
+		// The queue was already signaled and will notice this event too.
+	}
+}
+
+func (b *Brain) queueSettings() (capacity int, policy OverflowPolicy) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.queueCapacity, b.overflow
+}
+
+// enqueue adds the requested event to the queue while applying the
+// OverflowPolicy and reports the outcome to the caller if it is waiting for it.
+// Only events that were actually queued are recorded in the journal, and they
+// are recorded here so the journal has the same order as the queue.
+func (b *Brain) enqueue(queue []Event, req emitRequest) []Event {
+	queue, err := b.applyOverflowPolicy(queue, req)
+	if err == nil {
+		b.record(req.evt.Data)
+	}
+	b.setQueueDepth(len(queue))
+	req.result <- err
+	return queue
+}
+
+func (b *Brain) applyOverflowPolicy(queue []Event, req emitRequest) ([]Event, error) {
+	capacity, policy := b.queueSettings()
+	if capacity <= 0 || b.pendingEvents(queue) < capacity {
+		return append(queue, req.evt), nil
+	}
+
+	// The workers hold all events, so the new event is the oldest one that
+	// can still be dropped.
+	if policy == OverflowDropOldest && len(queue) == 0 {
+		policy = OverflowDropNewest
+	}
+
+	switch policy {
+	case OverflowDropOldest:
+		// The callbacks must not run in the goroutine that manages the queue,
+		// because they may emit events themselves.
+		oldest := queue[0]
+		b.dropEvent(oldest, policy)
+		go b.discardEvent(oldest, ErrEventDropped)
+		return append(queue[1:], req.evt), nil
+	case OverflowDropNewest:
+		b.dropEvent(req.evt, policy)
+		return queue, ErrEventDropped
+	case OverflowReject:
+		if !req.try {
+			b.dropEvent(req.evt, policy)
+		}
+	}
+
+	// With OverflowBlock we only get here via Brain.TryEmit.
+	return queue, ErrQueueFull
+}
+
+func (b *Brain) dropEvent(evt Event, policy OverflowPolicy) {
+	atomic.AddUint64(&b.droppedEvents, 1)
+	b.logger.Warn("Dropped event because the event queue is full",
+		zap.String("type", fmt.Sprintf("%T", evt.Data)),
+		zap.Stringer("policy", policy),
+	)
+}
+
+// discardEvent passes the reason why the event is never handled to its
+// callbacks.
+func (b *Brain) discardEvent(evt Event, err error) {
+	evt.Err = err
+	for _, callback := range evt.Callbacks {
+		callback(evt)
+	}
+}
@@ -0,0 +1,130 @@
+package brain
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// A Registration is returned when an event handler is registered and allows
+// removing or replacing the handler at runtime. It is safe to use while events
+// are being handled. Events whose handling already started when the handler is
+// replaced may still be passed to the previous function.
+type Registration struct {
+	brain   *Brain
+	handler *registeredHandler // nil if the registration failed
+}
+
+// Unregister removes the handler so it does not receive any more events, even
+// if they were emitted before. It reports whether the handler was registered.
+func (r *Registration) Unregister() bool {
+	if r == nil || r.handler == nil {
+		return false
+	}
+
+	b := r.brain
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.swapHandler(r.handler, nil)
+}
+
+// Replace swaps the function of the handler while keeping its position in the
+// execution order. The new function must handle the same event type. Options
+// like the name, priority or retry policy are kept as well.
+func (r *Registration) Replace(fun interface{}) error {
+	if r == nil || r.handler == nil {
+		return errors.New("handler was not registered")
+	}
+
+	old := r.handler
+	replacement, err := newRegisteredHandler(fun, HandlerOptions{Name: old.name})
+	if err != nil {
+		return err
+	}
+	if replacement.eventType != old.eventType {
+		return errors.New("replacement handler must have the same event type (" + old.eventType.String() + ")")
+	}
+
+	replacement.group = old.group
+	replacement.kind = old.kind
+	replacement.topic = old.topic
+	replacement.predicate = old.predicate
+	replacement.priority = old.priority
+	replacement.retry = old.retry
+	replacement.timeout = old.timeout
+	replacement.seq = old.seq
+
+	b := r.brain
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.swapHandler(old, replacement) {
+		return errors.New("handler was unregistered")
+	}
+
+	r.handler = replacement
+	return nil
+}
+
+// UnregisterGroup removes all handlers that were registered with the given
+// HandlerOptions.Group and returns how many were removed. Handlers without a
+// Group do not belong to any group, so the empty group removes nothing.
+func (b *Brain) UnregisterGroup(group string) int {
+	if group == "" {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var all []*registeredHandler
+	for _, handlers := range b.handlers {
+		all = append(all, handlers...)
+	}
+	for _, handlers := range b.topics {
+		all = append(all, handlers...)
+	}
+	all = append(all, b.predicates...)
+
+	n := 0
+	for _, h := range all {
+		if h.group == group && b.swapHandler(h, nil) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// swapHandler replaces the old handler with the replacement or removes it if
+// the replacement is nil. It reports whether the old handler was found. The
+// caller must hold the write lock.
+func (b *Brain) swapHandler(old, replacement *registeredHandler) bool {
+	handlers := b.handlerList(old)
+	for i, h := range handlers {
+		if h != old {
+			continue
+		}
+
+		if replacement == nil {
+			atomic.StoreInt32(&old.removed, 1)
+		}
+
+		// Create a new slice so we never modify a slice that is still used by
+		// an event that is currently being handled.
+		updated := make([]*registeredHandler, 0, len(handlers))
+		updated = append(updated, handlers[:i]...)
+		if replacement != nil {
+			updated = append(updated, replacement)
+		}
+		updated = append(updated, handlers[i+1:]...)
+		b.setHandlerList(old, updated)
+		return true
+	}
+
+	return false
+}
+
+func (h *registeredHandler) isRemoved() bool {
+	return atomic.LoadInt32(&h.removed) == 1
+}
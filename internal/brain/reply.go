@@ -0,0 +1,70 @@
+package brain
+
+import (
+	"context"
+	"reflect"
+)
+
+// Reply adds a result to the event that is currently being handled. The
+// results of all handlers are passed to the callbacks of the event and they
+// are returned by Brain.EmitAndWait. Replying also marks the event as handled.
+// Results of handlers that were abandoned because they timed out are ignored
+// once all other handlers of the event ran.
+func Reply(ctx context.Context, result interface{}) {
+	if state := eventStateOf(ctx); state != nil {
+		state.update(func(evt *Event) {
+			evt.Results = append(evt.Results, result)
+			evt.Handled = true
+		})
+	}
+}
+
+// EmitAndWait emits the event and waits until all of its handlers ran. It
+// returns the handled Event, which contains all results that were passed to
+// Reply, together with the combined errors of the handlers. The context only
+// limits how long the caller waits and is not passed to the handlers. If the
+// OverflowPolicy discards the event, EmitAndWait returns ErrEventDropped or
+// ErrQueueFull.
+//
+// EmitAndWait must never be called from a handler. The event is queued like
+// any other event, so it may wait for the calling handler to return, e.g. if
+// events are handled one at a time or if it has the same EventKeyFunc key as
+// the event of the calling handler. In this case the call only ends when its
+// context expires.
+func (b *Brain) EmitAndWait(ctx context.Context, event interface{}) (Event, error) {
+	done := make(chan Event, 1)
+	err := b.emit(event, []func(Event){func(evt Event) {
+		done <- evt
+	}})
+	if err != nil {
+		return Event{Data: event, Err: err}, err
+	}
+
+	select {
+	case evt := <-done:
+		return evt, evt.Err
+	case <-ctx.Done():
+		return Event{Data: event, Err: ctx.Err()}, ctx.Err()
+	}
+}
+
+// Result sets target, which must be a non-nil pointer, to the first result of
+// the event that is assignable to the type target points to. It reports
+// whether such a result exists.
+func (evt Event) Result(target interface{}) bool {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		panic("brain: Event.Result target must be a non-nil pointer")
+	}
+
+	elem := ptr.Elem()
+	for _, result := range evt.Results {
+		value := reflect.ValueOf(result)
+		if value.IsValid() && value.Type().AssignableTo(elem.Type()) {
+			elem.Set(value)
+			return true
+		}
+	}
+
+	return false
+}
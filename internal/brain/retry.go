@@ -0,0 +1,94 @@
+package brain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// A RetryPolicy decides if and when a failed event handler is executed again.
+// All attempts together are limited by the handler timeout and they are
+// stopped early if the context of the event is canceled, e.g. because the
+// deadline that was passed to Brain.Shutdown expired.
+type RetryPolicy struct {
+	MaxAttempts    int           // total number of attempts including the first one, values below two disable retries
+	InitialBackoff time.Duration // wait time before the first retry, defaults to 100ms
+	MaxBackoff     time.Duration // upper limit for the wait time between attempts, defaults to 30s
+	Multiplier     float64       // factor by which the wait time grows after each retry, defaults to 2
+	Jitter         float64       // randomizes each wait time by up to this fraction (e.g. 0.2 means ±20%)
+
+	// Retryable reports whether an error is temporary and the handler should
+	// be executed again. If it is nil, all errors are retried.
+	Retryable func(error) bool
+}
+
+// backoff returns how long to wait before the given retry (starting at one).
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	initial, max, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	d := float64(initial) * math.Pow(multiplier, float64(retry-1))
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if p.Retryable == nil {
+		return true
+	}
+	return p.Retryable(err)
+}
+
+// run executes fun until it succeeds, the error is not retryable, all attempts
+// are used up or the context is done. The onRetry function is called before
+// waiting for the next attempt.
+func (p *RetryPolicy) run(ctx context.Context, clk clock.Clock, fun func() error, onRetry func(attempt int, wait time.Duration, err error)) error {
+	if p == nil || p.MaxAttempts < 2 {
+		return fun()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fun()
+		if err == nil || !p.retryable(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		wait := p.backoff(attempt)
+		if onRetry != nil {
+			onRetry(attempt, wait, err)
+		}
+
+		timer := clk.Timer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("stopped retrying after %d attempts: %w (last error: %v)", attempt, ctx.Err(), err)
+		}
+	}
+}
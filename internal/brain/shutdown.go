@@ -0,0 +1,79 @@
+package brain
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gillepool/botty/internal/events"
+	"go.uber.org/zap"
+)
+
+// ErrShutdown is returned when events are emitted after Brain.Shutdown was
+// called or if Brain.Shutdown is called more than once.
+var ErrShutdown = errors.New("brain was shut down")
+
+// shutdownGracePeriod is how long Brain.Shutdown waits for the handlers of the
+// ShutdownEvent after its context expired.
+const shutdownGracePeriod = 5 * time.Second
+
+// Shutdown stops accepting new events and waits until all events that are
+// already queued are handled. Afterwards it emits the ShutdownEvent, which
+// adapters use to close their connections, and makes Brain.HandleEvents return.
+// If Brain.HandleEvents is not running, the queued events are discarded and
+// their callbacks receive ErrShutdown.
+//
+// If the context expires before all queued events are handled, the context of
+// the running handlers is canceled, the remaining events are discarded and the
+// context error is returned. The ShutdownEvent is handled in any case, but
+// Shutdown waits at most shutdownGracePeriod for it. If its handlers take
+// longer, they keep running after Shutdown returned until Brain.HandleEvents
+// returns.
+func (b *Brain) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	if b.isClosed() {
+		b.mu.Unlock()
+		return ErrShutdown
+	}
+	running, cancelEvents := b.isHandlingEvents(), b.cancelEvents
+	atomic.StoreInt32(&b.closed, 1)
+	b.mu.Unlock()
+
+	b.logger.Info("Shutting down")
+	close(b.stopInput)
+
+	if !running {
+		// Nobody is handling the events, so we discard them and only let the
+		// handlers of the ShutdownEvent close any resources.
+		discarded := 0
+		for evt := range b.eventsLoop {
+			b.passedOnDone()
+			b.discardEvent(evt, ErrShutdown)
+			discarded++
+		}
+		if discarded > 0 {
+			b.logger.Warn("Discarded events that were never handled", zap.Int("count", discarded))
+		}
+
+		b.handleEvent(context.Background(), Event{Data: events.ShutdownEvent{}})
+		return nil
+	}
+
+	select {
+	case <-b.stopped:
+		return nil
+	case <-ctx.Done():
+		// Make the running handlers stop and discard all remaining events.
+		cancelEvents()
+
+		timer := time.NewTimer(shutdownGracePeriod)
+		defer timer.Stop()
+		select {
+		case <-b.stopped:
+		case <-timer.C:
+			b.logger.Warn("Shutdown returns before the ShutdownEvent was handled")
+		}
+		return ctx.Err()
+	}
+}
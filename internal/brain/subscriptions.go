@@ -0,0 +1,196 @@
+package brain
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// A TopicEvent is an event that belongs to a topic. It is passed to all
+// handlers that were registered for this topic via Brain.SubscribeTopic in
+// addition to the handlers for its type.
+type TopicEvent interface {
+	Topic() string
+}
+
+// The subscriptionKind determines how a handler is matched against events.
+type subscriptionKind int
+
+const (
+	subscribeType      subscriptionKind = iota // match the event type or an interface it implements
+	subscribePredicate                         // match if the predicate returns true
+	subscribeTopic                             // match if the event is a TopicEvent of the topic
+)
+
+var emptyInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// SubscribeAll registers a handler for every event, e.g. for auditing or
+// logging. The last argument of the handler function must be an interface{}.
+// Apart from that, the same rules as for RegisterHandler apply.
+func (b *Brain) SubscribeAll(fun interface{}, opts HandlerOptions) *Registration {
+	handler, err := newRegisteredHandler(fun, opts)
+	if err == nil && handler.eventType != emptyInterface {
+		err = errors.New("handler for all events must accept an interface{}")
+	}
+	if err != nil {
+		b.RegistrationErrs = append(b.RegistrationErrs, err)
+		return &Registration{brain: b}
+	}
+
+	return b.addHandler(handler)
+}
+
+// SubscribeFunc registers a handler for all events for which the predicate
+// returns true. The event argument of the handler function can be an
+// interface{}, in which case it receives all matching events, or a more
+// specific type, in which case only events of this type are passed to the
+// predicate. Predicates are evaluated for every event, so they should be fast.
+func (b *Brain) SubscribeFunc(predicate func(event interface{}) bool, fun interface{}, opts HandlerOptions) *Registration {
+	handler, err := newRegisteredHandler(fun, opts)
+	if err == nil && predicate == nil {
+		err = errors.New("predicate must not be nil")
+	}
+	if err != nil {
+		b.RegistrationErrs = append(b.RegistrationErrs, err)
+		return &Registration{brain: b}
+	}
+
+	handler.kind = subscribePredicate
+	handler.predicate = predicate
+	return b.addHandler(handler)
+}
+
+// SubscribeTopic registers a handler for all events that implement the
+// TopicEvent interface and return the given topic. The type of the event
+// argument of the handler function works like for SubscribeFunc.
+func (b *Brain) SubscribeTopic(topic string, fun interface{}, opts HandlerOptions) *Registration {
+	handler, err := newRegisteredHandler(fun, opts)
+	if err != nil {
+		b.RegistrationErrs = append(b.RegistrationErrs, err)
+		return &Registration{brain: b}
+	}
+
+	handler.kind = subscribeTopic
+	handler.topic = topic
+	return b.addHandler(handler)
+}
+
+// addHandler assigns the next sequence number to the handler and adds it to
+// the collection that corresponds to its kind of subscription.
+func (b *Brain) addHandler(handler *registeredHandler) *Registration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlerSeq++
+	handler.seq = b.handlerSeq
+	b.setHandlerList(handler, append(b.handlerList(handler), handler))
+
+	return &Registration{brain: b, handler: handler}
+}
+
+// handlerList returns the collection that contains the handler. The caller
+// must hold the lock.
+func (b *Brain) handlerList(handler *registeredHandler) []*registeredHandler {
+	switch handler.kind {
+	case subscribePredicate:
+		return b.predicates
+	case subscribeTopic:
+		return b.topics[handler.topic]
+	default:
+		return b.handlers[handler.eventType]
+	}
+}
+
+// setHandlerList replaces the collection that contains the handler and
+// invalidates the cached handlers. The caller must hold the write lock.
+func (b *Brain) setHandlerList(handler *registeredHandler, list []*registeredHandler) {
+	switch {
+	case handler.kind == subscribePredicate:
+		b.predicates = list
+	case handler.kind == subscribeTopic && len(list) == 0:
+		delete(b.topics, handler.topic)
+	case handler.kind == subscribeTopic:
+		b.topics[handler.topic] = list
+	case len(list) == 0:
+		delete(b.handlers, handler.eventType)
+	default:
+		b.handlers[handler.eventType] = list
+	}
+
+	b.cacheMu.Lock()
+	b.handlerCache = make(map[reflect.Type][]*registeredHandler)
+	b.cacheMu.Unlock()
+}
+
+// determineHandlers returns all handlers for the given event in the order in
+// which they must be executed (see HandlerOptions) together with the
+// middleware that wraps each of them. The handlers that match by type are
+// cached, so only predicates and topics need to be checked for each event.
+func (b *Brain) determineHandlers(data interface{}) ([]*registeredHandler, []Middleware) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	eventType := reflect.TypeOf(data)
+	handlers := b.typeHandlers(eventType)
+
+	var extra []*registeredHandler
+	for _, h := range b.predicates {
+		if eventType.AssignableTo(h.eventType) && h.predicate(data) {
+			extra = append(extra, h)
+		}
+	}
+	if evt, ok := data.(TopicEvent); ok {
+		for _, h := range b.topics[evt.Topic()] {
+			if eventType.AssignableTo(h.eventType) {
+				extra = append(extra, h)
+			}
+		}
+	}
+
+	if len(extra) > 0 {
+		handlers = append(append([]*registeredHandler(nil), handlers...), extra...)
+		sortHandlers(handlers)
+	}
+
+	middleware := make([]Middleware, len(b.middleware))
+	copy(middleware, b.middleware)
+
+	return handlers, middleware
+}
+
+// typeHandlers returns the sorted handlers that were registered for the event
+// type or an interface it implements. The returned slice must not be modified.
+// The caller must hold the read lock.
+func (b *Brain) typeHandlers(eventType reflect.Type) []*registeredHandler {
+	b.cacheMu.Lock()
+	defer b.cacheMu.Unlock()
+
+	if handlers, ok := b.handlerCache[eventType]; ok {
+		return handlers
+	}
+
+	var handlers []*registeredHandler
+	for handlerType, hh := range b.handlers {
+		if handlerType == eventType {
+			handlers = append(handlers, hh...)
+		}
+
+		if handlerType.Kind() == reflect.Interface && eventType.Implements(handlerType) {
+			handlers = append(handlers, hh...)
+		}
+	}
+
+	sortHandlers(handlers)
+	b.handlerCache[eventType] = handlers
+
+	return handlers
+}
+
+func sortHandlers(handlers []*registeredHandler) {
+	sort.Slice(handlers, func(i, j int) bool {
+		if handlers[i].priority != handlers[j].priority {
+			return handlers[i].priority > handlers[j].priority
+		}
+		return handlers[i].seq < handlers[j].seq
+	})
+}
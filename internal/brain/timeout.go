@@ -0,0 +1,87 @@
+package brain
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// NoTimeout can be used as HandlerOptions.Timeout to let a handler run without
+// any time limit, regardless of the timeout of the Brain.
+const NoTimeout time.Duration = -1
+
+// ignoredCancellationDelay is how long an abandoned handler may keep running
+// after its context was canceled before we warn that it ignores ctx.Done().
+const ignoredCancellationDelay = time.Second
+
+// SetHandlerTimeout sets the default time limit for all handlers that do not
+// specify their own HandlerOptions.Timeout. Zero or negative values disable
+// the default timeout. The initial value is one minute.
+func (b *Brain) SetHandlerTimeout(timeout time.Duration) {
+	b.mu.Lock()
+	b.handlerTimeout = timeout
+	b.mu.Unlock()
+}
+
+// LeakedHandlers returns the number of handlers that were abandoned because
+// they timed out or because the shutdown deadline expired, but that are still
+// running because they did not return after their context was canceled.
+func (b *Brain) LeakedHandlers() int64 {
+	return atomic.LoadInt64(&b.leakedHandlers)
+}
+
+func (b *Brain) timeoutOf(handler *registeredHandler) time.Duration {
+	if handler.timeout != 0 {
+		return handler.timeout
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.handlerTimeout
+}
+
+// callEventHandler executes the handler in a new goroutine and stops waiting
+// for it when the context is done. In this case the handler is abandoned and
+// counted as leaked until it eventually returns.
+func (b *Brain) callEventHandler(ctx context.Context, handler *registeredHandler, event reflect.Value) error {
+	done := make(chan error, 1) // buffered so an abandoned handler can always return
+	go func() {
+		done <- handler.fun(ctx, event)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		b.abandon(handler, done)
+		return ctx.Err()
+	}
+}
+
+func (b *Brain) abandon(handler *registeredHandler, done <-chan error) {
+	atomic.AddInt64(&b.leakedHandlers, 1)
+
+	go func() {
+		defer atomic.AddInt64(&b.leakedHandlers, -1)
+
+		timer := b.clock.Timer(b.ignoredCancellationDelay)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		b.logger.Warn("Event handler ignores the cancellation of its context",
+			zap.String("handler", handler.name),
+			zap.Int64("leaked", b.LeakedHandlers()),
+		)
+
+		<-done
+		b.logger.Info("Leaked event handler returned", zap.String("handler", handler.name))
+	}()
+}
@@ -0,0 +1,168 @@
+package brain
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gillepool/botty/internal/events"
+)
+
+// An EventKeyFunc returns the key that determines the order of events when
+// they are processed concurrently. Events with the same key are always handled
+// one after another and in the order in which they were emitted, while events
+// with different keys may be handled in parallel.
+type EventKeyFunc func(Event) string
+
+// DefaultEventKey is the EventKeyFunc that is used unless another one is set
+// via Brain.SetEventKeyFunc. It uses the channel of a ReceiveMessageEvent and
+// the empty key for any other event, which means that all other events are
+// still handled in order.
+func DefaultEventKey(evt Event) string {
+	if msg, ok := evt.Data.(events.ReceiveMessageEvent); ok {
+		return msg.Channel
+	}
+	return ""
+}
+
+// SetConcurrency sets the number of workers that handle events in parallel.
+// Values smaller than two mean that all events are handled one at a time in
+// Brain.HandleEvents, which is the default. This function must be called
+// before Brain.HandleEvents.
+func (b *Brain) SetConcurrency(workers int) {
+	b.mu.Lock()
+	b.workers = workers
+	b.mu.Unlock()
+}
+
+// SetEventKeyFunc sets the function that decides which events must be handled
+// in order when the Brain uses more than one worker (see SetConcurrency).
+// Passing nil restores the DefaultEventKey.
+func (b *Brain) SetEventKeyFunc(fun EventKeyFunc) {
+	if fun == nil {
+		fun = DefaultEventKey
+	}
+
+	b.mu.Lock()
+	b.eventKey = fun
+	b.mu.Unlock()
+}
+
+// The eventWorkers handle events concurrently while guaranteeing that events
+// with the same key are handled sequentially. Each key has its own queue and
+// at most one worker handles the events of a key at any time, so a slow key
+// never delays events with other keys. The queues have no limit of their own
+// because dispatch must never block. Instead, dispatched events count against
+// the capacity of the event queue of the Brain until they are handled.
+type eventWorkers struct {
+	key EventKeyFunc
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	cond    *sync.Cond           // signaled when a key becomes ready or the workers are stopped
+	pending map[string]*keyQueue // keys whose events are queued or being handled
+	ready   []string             // keys with queued events that no worker handles yet
+	stopped bool                 // set by stop, the workers exit once no key is ready
+}
+
+// A keyQueue contains the events of a key that wait to be handled.
+type keyQueue struct {
+	items []workItem
+}
+
+type workItem struct {
+	ctx context.Context
+	evt Event
+}
+
+func (b *Brain) startWorkers(n int, key EventKeyFunc) *eventWorkers {
+	w := &eventWorkers{
+		key:     key,
+		pending: map[string]*keyQueue{},
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	w.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer w.wg.Done()
+			for {
+				key, item, ok := w.next()
+				if !ok {
+					return
+				}
+				b.handleEvent(item.ctx, item.evt)
+				w.done(key)
+				b.passedOnDone()
+			}
+		}()
+	}
+
+	return w
+}
+
+// dispatch queues the event for its key. It never blocks, even if the events
+// of the key are handled slowly, since the Brain stops passing on events once
+// its queue capacity is reached.
+func (w *eventWorkers) dispatch(ctx context.Context, evt Event) {
+	key := w.key(evt)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	q, ok := w.pending[key]
+	if !ok {
+		// Nobody handles this key right now, so any worker can take it.
+		q = new(keyQueue)
+		w.pending[key] = q
+		w.ready = append(w.ready, key)
+		w.cond.Signal()
+	}
+	q.items = append(q.items, workItem{ctx: ctx, evt: evt})
+}
+
+// next waits for a ready key and returns its oldest event. It returns false
+// once the workers are stopped and all events were handled.
+func (w *eventWorkers) next() (string, workItem, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.ready) == 0 {
+		if w.stopped {
+			return "", workItem{}, false
+		}
+		w.cond.Wait()
+	}
+
+	key := w.ready[0]
+	w.ready = w.ready[1:]
+
+	q := w.pending[key]
+	item := q.items[0]
+	q.items = q.items[1:]
+	return key, item, true
+}
+
+// done marks the event of the key as handled. If more events of the key are
+// waiting, the key is ready again behind all other ready keys.
+func (w *eventWorkers) done(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending[key].items) == 0 {
+		delete(w.pending, key)
+		return
+	}
+
+	w.ready = append(w.ready, key)
+	w.cond.Signal()
+}
+
+// stop waits until all workers have handled their remaining events.
+func (w *eventWorkers) stop() {
+	w.mu.Lock()
+	w.stopped = true
+	w.cond.Broadcast()
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
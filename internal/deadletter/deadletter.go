@@ -0,0 +1,189 @@
+// Package deadletter persists events that could not be delivered to their
+// handlers in the storage.Storage, so they can be inspected, retried or purged.
+package deadletter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/events"
+	"github.com/gillepool/botty/internal/storage"
+	"go.uber.org/zap"
+)
+
+// keyPrefix is prepended to the IDs of all entries in the storage.
+const keyPrefix = "deadletter:"
+
+// listPageSize is the number of keys that List requests from the storage at
+// once.
+const listPageSize = 100
+
+// An Entry is a single failed delivery of an event to one of its handlers.
+type Entry struct {
+	ID        string          `json:"id"`
+	EventType string          `json:"event_type"` // the name that was passed to events.Register
+	Payload   json.RawMessage `json:"payload"`    // the JSON encoded event
+	Handler   string          `json:"handler"`
+	Error     string          `json:"error"`
+	Time      time.Time       `json:"time"`
+	Attempts  int             `json:"attempts"` // number of failed deliveries, including retries
+}
+
+// The Queue implements the brain.DeadLetterQueue interface.
+type Queue struct {
+	store  *storage.Storage
+	logger *zap.Logger
+}
+
+var _ brain.DeadLetterQueue = (*Queue)(nil)
+
+// New creates a Queue that persists its entries in the given storage.
+func New(store *storage.Storage, logger *zap.Logger) *Queue {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Queue{store: store, logger: logger}
+}
+
+// Add records the failure as a new Entry. It returns an error if the event
+// type was not registered via events.Register.
+func (q *Queue) Add(failure brain.HandlerFailure) error {
+	eventType, payload, err := events.Marshal(failure.Data)
+	if err != nil {
+		return err
+	}
+
+	entry := Entry{
+		ID:        newID(failure.Time),
+		EventType: eventType,
+		Payload:   payload,
+		Handler:   failure.Handler,
+		Error:     failure.Err.Error(),
+		Time:      failure.Time,
+		Attempts:  1,
+	}
+
+	q.logger.Info("Adding dead letter", zap.String("id", entry.ID), zap.String("handler", entry.Handler))
+	return q.store.Set(keyPrefix+entry.ID, entry)
+}
+
+// newID returns a unique ID that sorts by the time of the failure. It consists
+// of the UTC time with a fixed width and a random suffix, so IDs of failures at
+// the same time never collide, not even across restarts.
+func newID(t time.Time) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return t.UTC().Format("20060102150405.000000000") + "-" + hex.EncodeToString(suffix)
+}
+
+// List returns all entries ordered by their ID.
+func (q *Queue) List() ([]Entry, error) {
+	var ids []string
+	for cursor := ""; ; {
+		keys, next, err := q.store.Scan(keyPrefix, cursor, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, keyPrefix))
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	// The order of a scan depends on the Memory and it may even return a key
+	// more than once.
+	sort.Strings(ids)
+
+	var entries []Entry
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+
+		entry, ok, err := q.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// Get returns the entry with the given ID.
+func (q *Queue) Get(id string) (Entry, bool, error) {
+	var entry Entry
+	ok, err := q.store.Get(keyPrefix+id, &entry)
+	return entry, ok, err
+}
+
+// Delete removes the entry with the given ID and reports whether it existed.
+func (q *Queue) Delete(id string) (bool, error) {
+	return q.store.Delete(keyPrefix + id)
+}
+
+// Purge removes all entries and returns how many were deleted.
+func (q *Queue) Purge() (int, error) {
+	entries, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, entry := range entries {
+		ok, err := q.Delete(entry.ID)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Retry delivers the event of the entry with the given ID to its handler
+// again. If the handler succeeds the entry is removed, otherwise the entry is
+// updated with the new error, which is also returned.
+func (q *Queue) Retry(ctx context.Context, b *brain.Brain, id string) error {
+	entry, ok, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("dead letter %q does not exist", id)
+	}
+
+	data, err := events.Unmarshal(entry.EventType, entry.Payload)
+	if err != nil {
+		return err
+	}
+
+	deliveryErr := b.Deliver(ctx, entry.Handler, data)
+	if deliveryErr == nil {
+		_, err = q.Delete(id)
+		return err
+	}
+
+	entry.Error = deliveryErr.Error()
+	entry.Attempts++
+	if err := q.store.Set(keyPrefix+id, entry); err != nil {
+		q.logger.Error("Failed to update dead letter", zap.String("id", id), zap.Error(err))
+	}
+
+	return deliveryErr
+}
@@ -0,0 +1,110 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/events"
+	"github.com/gillepool/botty/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestQueueRetry(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	queue := New(storage.NewStorage(logger), logger)
+	b := brain.NewBrain(logger)
+
+	fail := true
+	var received []string
+	b.RegisterHandlerWithOptions(func(evt events.ReceiveMessageEvent) error {
+		if fail {
+			return errors.New("service unavailable")
+		}
+		received = append(received, evt.Text)
+		return nil
+	}, brain.HandlerOptions{Name: "flaky"})
+
+	err := queue.Add(brain.HandlerFailure{
+		Data:    events.ReceiveMessageEvent{Text: "hello", Channel: "general"},
+		Handler: "flaky",
+		Err:     errors.New("service unavailable"),
+		Time:    time.Now(),
+	})
+	require.NoError(t, err)
+
+	entries, err := queue.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "ReceiveMessageEvent", entries[0].EventType)
+	assert.Equal(t, "flaky", entries[0].Handler)
+	assert.Equal(t, "service unavailable", entries[0].Error)
+
+	id := entries[0].ID
+	assert.Error(t, queue.Retry(context.Background(), b, id))
+	entry, ok, err := queue.Get(id)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, entry.Attempts)
+
+	fail = false
+	assert.NoError(t, queue.Retry(context.Background(), b, id))
+	assert.Equal(t, []string{"hello"}, received)
+
+	entries, err = queue.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestQueuePurge(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	store := storage.NewStorage(logger)
+	queue := New(store, logger)
+
+	require.NoError(t, store.Set("unrelated", "value"))
+	for i := 0; i < 3; i++ {
+		err := queue.Add(brain.HandlerFailure{Data: events.InitEvent{}, Handler: "h", Err: errors.New("failed"), Time: time.Now()})
+		require.NoError(t, err)
+	}
+
+	n, err := queue.Purge()
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	keys, err := store.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unrelated"}, keys)
+}
+
+func TestQueueListOrdersByTime(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	queue := New(storage.NewStorage(logger), logger)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		start.Add(36 * time.Millisecond),
+		start.Add(35 * time.Millisecond),
+		start.Add(time.Hour),
+		start.Add(35 * time.Millisecond),
+	}
+	for i, tm := range times {
+		err := queue.Add(brain.HandlerFailure{Data: events.InitEvent{}, Handler: fmt.Sprint(i), Err: errors.New("failed"), Time: tm})
+		require.NoError(t, err)
+	}
+
+	entries, err := queue.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 4) // failures at the same time get different IDs
+
+	var handlers []string
+	for _, entry := range entries {
+		handlers = append(handlers, entry.Handler)
+	}
+	assert.ElementsMatch(t, []string{"1", "3"}, handlers[:2])
+	assert.Equal(t, []string{"0", "2"}, handlers[2:])
+}
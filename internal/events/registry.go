@@ -0,0 +1,87 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// The registry maps event type names to the concrete Go types so events can be
+// serialized (e.g. when they are persisted) and restored later.
+var registry = struct {
+	sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}{
+	types: map[string]reflect.Type{},
+	names: map[reflect.Type]string{},
+}
+
+func init() {
+	Register("InitEvent", InitEvent{})
+	Register("ShutdownEvent", ShutdownEvent{})
+	Register("ReceiveMessageEvent", ReceiveMessageEvent{})
+}
+
+// Register makes the type of the given example event known under the given
+// name so it can be passed to Marshal and Unmarshal. Registering the same name
+// or type twice overwrites the previous registration.
+func Register(name string, example interface{}) {
+	typ := reflect.TypeOf(example)
+
+	registry.Lock()
+	registry.types[name] = typ
+	registry.names[typ] = name
+	registry.Unlock()
+}
+
+// TypeName returns the name under which the type of the given event was
+// registered. If the type is not registered, the Go type name is returned and
+// ok is false.
+func TypeName(event interface{}) (name string, ok bool) {
+	typ := reflect.TypeOf(event)
+
+	registry.RLock()
+	name, ok = registry.names[typ]
+	registry.RUnlock()
+
+	if !ok {
+		name = fmt.Sprint(typ)
+	}
+	return name, ok
+}
+
+// Marshal encodes the given event as JSON and returns it together with its
+// registered type name. It returns an error if the event type is not registered.
+func Marshal(event interface{}) (name string, payload []byte, err error) {
+	name, ok := TypeName(event)
+	if !ok {
+		return name, nil, fmt.Errorf("event type %s is not registered", name)
+	}
+
+	payload, err = json.Marshal(event)
+	if err != nil {
+		return name, nil, fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	return name, payload, nil
+}
+
+// Unmarshal decodes the JSON payload into a new value of the event type that
+// was registered under the given name. Note that fields of type interface{}
+// (e.g. ReceiveMessageEvent.Data) cannot be restored to their original type.
+func Unmarshal(name string, payload []byte) (interface{}, error) {
+	registry.RLock()
+	typ, ok := registry.types[name]
+	registry.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("event type %q is not registered", name)
+	}
+
+	ptr := reflect.New(typ)
+	if err := json.Unmarshal(payload, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+	return ptr.Elem().Interface(), nil
+}
@@ -0,0 +1,137 @@
+// Package journal implements an append-only log of all events that are emitted
+// into the brain and allows replaying them into a fresh brain.Brain, e.g. to
+// reproduce incidents while debugging.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/events"
+)
+
+// An Entry is a single event in the journal. The event is serialized via the
+// events registry, so its type must be registered with events.Register.
+type Entry struct {
+	Seq  uint64          `json:"seq"`
+	Time time.Time       `json:"time"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Event decodes the event of the entry into its registered type.
+func (e Entry) Event() (interface{}, error) {
+	return events.Unmarshal(e.Type, e.Data)
+}
+
+// The Writer appends entries as JSON lines to an io.Writer. It implements the
+// brain.Journal interface.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer // may be nil
+	seq    uint64
+	clock  clock.Clock
+}
+
+var _ brain.Journal = (*Writer)(nil)
+
+// NewWriter creates a Writer that appends entries to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, clock: clock.New()}
+}
+
+// Create opens the file at the given path for appending, creating it if
+// necessary, and returns a Writer for it. The caller must call Close.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	w := NewWriter(f)
+	w.closer = f
+	return w, nil
+}
+
+// SetClock replaces the clock that is used to timestamp the entries.
+func (w *Writer) SetClock(c clock.Clock) {
+	w.mu.Lock()
+	w.clock = c
+	w.mu.Unlock()
+}
+
+// Record appends the event to the journal.
+func (w *Writer) Record(event interface{}) error {
+	name, data, err := events.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq++
+	line, err := json.Marshal(Entry{
+		Seq:  w.seq,
+		Time: w.clock.Now(),
+		Type: name,
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying file if the Writer was created via Create.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+// Read parses all entries from the JSON lines in r.
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid journal entry in line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// ReadFile parses all entries of the journal at the given path.
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
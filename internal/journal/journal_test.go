@@ -0,0 +1,112 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestJournalReplay(t *testing.T) {
+	mock := clock.NewMock()
+	buf := new(bytes.Buffer)
+	writer := NewWriter(buf)
+	writer.SetClock(mock)
+
+	recorded := brain.NewBrain(zaptest.NewLogger(t))
+	recorded.SetJournal(writer)
+	recorded.Emit(events.ReceiveMessageEvent{Text: "first", Channel: "general"})
+	mock.Add(time.Second)
+	recorded.Emit(events.ReceiveMessageEvent{Text: "second", Channel: "random"})
+
+	entries, err := Read(buf)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint64(1), entries[0].Seq)
+	assert.Equal(t, "ReceiveMessageEvent", entries[0].Type)
+	assert.Equal(t, time.Second, entries[1].Time.Sub(entries[0].Time))
+
+	// replay the journal into a fresh brain
+	fresh := brain.NewBrain(zaptest.NewLogger(t))
+	var received []string
+	fresh.RegisterHandler(func(evt events.ReceiveMessageEvent) {
+		received = append(received, evt.Channel+": "+evt.Text)
+	})
+
+	started := make(chan struct{})
+	fresh.RegisterHandler(func(evt events.InitEvent) {
+		close(started)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		fresh.HandleEvents()
+		close(done)
+	}()
+	<-started
+
+	require.NoError(t, NewReplayer(entries, fresh).Run(context.Background(), 0))
+	require.NoError(t, fresh.Shutdown(context.Background()))
+	<-done
+
+	assert.Equal(t, []string{"general: first", "random: second"}, received)
+}
+
+type recordingEmitter []interface{}
+
+func (e *recordingEmitter) Emit(event interface{}, _ ...func(brain.Event)) {
+	*e = append(*e, event)
+}
+
+func TestReplayerStep(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := NewWriter(buf)
+	require.NoError(t, writer.Record(events.InitEvent{}))
+	require.NoError(t, writer.Record(events.ReceiveMessageEvent{Text: "hello"}))
+
+	entries, err := Read(buf)
+	require.NoError(t, err)
+
+	emitter := new(recordingEmitter)
+	replayer := NewReplayer(entries, emitter)
+
+	entry, ok, err := replayer.Step()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "InitEvent", entry.Type)
+	assert.Equal(t, 1, replayer.Remaining())
+
+	_, ok, err = replayer.Step()
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	_, ok, _ = replayer.Step()
+	assert.False(t, ok)
+	assert.Equal(t, []interface{}{events.InitEvent{}, events.ReceiveMessageEvent{Text: "hello"}}, []interface{}(*emitter))
+}
+
+func TestReplayerSkipsUndecodableEntries(t *testing.T) {
+	entries := []Entry{
+		{Seq: 1, Type: "UnknownEvent", Data: []byte(`{}`)},
+		{Seq: 2, Type: "ReceiveMessageEvent", Data: []byte(`{"Text":"hello"}`)},
+	}
+
+	emitter := new(recordingEmitter)
+	replayer := NewReplayer(entries, emitter)
+
+	entry, ok, err := replayer.Step()
+	assert.Error(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), entry.Seq)
+	assert.Equal(t, 1, replayer.Remaining())
+
+	require.NoError(t, replayer.Run(context.Background(), 0))
+	assert.Equal(t, []interface{}{events.ReceiveMessageEvent{Text: "hello"}}, []interface{}(*emitter))
+}
@@ -0,0 +1,107 @@
+package journal
+
+import (
+	"context"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/gillepool/botty/internal/brain"
+)
+
+// An Emitter receives the replayed events. It is implemented by the
+// brain.Brain.
+type Emitter interface {
+	Emit(event interface{}, callbacks ...func(brain.Event))
+}
+
+// A Replayer emits the events of a journal again, either step by step or with
+// the timing in which they were originally recorded.
+type Replayer struct {
+	entries []Entry
+	pos     int
+	emitter Emitter
+	clock   clock.Clock
+}
+
+// NewReplayer creates a Replayer that emits the events of the given entries
+// into the Emitter, which is usually a freshly created brain.Brain.
+func NewReplayer(entries []Entry, emitter Emitter) *Replayer {
+	return &Replayer{
+		entries: entries,
+		emitter: emitter,
+		clock:   clock.New(),
+	}
+}
+
+// SetClock replaces the clock that is used to wait between events in Run.
+func (r *Replayer) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// Remaining returns the number of entries that were not replayed yet.
+func (r *Replayer) Remaining() int {
+	return len(r.entries) - r.pos
+}
+
+// Step emits the next event and returns its entry. It returns false if all
+// events were replayed already. If the event of the entry cannot be decoded,
+// the entry is skipped and the error is returned, so the next call of Step
+// continues with the following entry.
+func (r *Replayer) Step() (Entry, bool, error) {
+	if r.pos >= len(r.entries) {
+		return Entry{}, false, nil
+	}
+
+	entry := r.entries[r.pos]
+	r.pos++
+
+	event, err := entry.Event()
+	if err != nil {
+		return entry, true, err
+	}
+
+	r.emitter.Emit(event)
+	return entry, true, nil
+}
+
+// Run emits all remaining events. The speed controls the waiting time between
+// two events relative to the recorded timestamps: a speed of 1 reproduces the
+// original timing, 2 replays twice as fast and a speed of zero or less emits
+// all events without waiting. Run stops early if the context is done or if an
+// event cannot be decoded. Calling Run again continues after that event.
+func (r *Replayer) Run(ctx context.Context, speed float64) error {
+	for r.pos < len(r.entries) {
+		if speed > 0 && r.pos > 0 {
+			delay := r.entries[r.pos].Time.Sub(r.entries[r.pos-1].Time)
+			if err := r.wait(ctx, time.Duration(float64(delay)/speed)); err != nil {
+				return err
+			}
+		}
+
+		if _, _, err := r.Step(); err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Replayer) wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := r.clock.Timer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
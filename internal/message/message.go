@@ -31,5 +31,10 @@ func (msg *Message) RespondE(text string, args ...interface{}) error {
 		text = fmt.Sprintf(text, args...)
 	}
 
-	return msg.Adapter.Send(text, msg.Channel)
+	ctx := msg.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return adapter.SendContext(ctx, msg.Adapter, text, msg.Channel)
 }
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gillepool/botty/internal/adapter"
+	"github.com/gillepool/botty/internal/brain"
+)
+
+// BrainMetrics implements the brain.MetricsSink and records the throughput of
+// the Brain in a Registry.
+type BrainMetrics struct {
+	emitted   *Counter
+	handled   *Counter
+	latency   *Histogram
+	errors    *Counter
+	timeouts  *Counter
+	queueSize *Gauge
+}
+
+// NewBrainMetrics registers all metrics of the Brain in the given registry.
+// The result can be passed to brain.WithMetrics.
+func NewBrainMetrics(r *Registry) *BrainMetrics {
+	return &BrainMetrics{
+		emitted:   r.Counter("botty_events_emitted_total", "Number of events that were emitted.", "type"),
+		handled:   r.Counter("botty_events_handled_total", "Number of events that were passed to all of their handlers.", "type"),
+		latency:   r.Histogram("botty_handler_duration_seconds", "Time it took to execute an event handler, including retries.", nil, "type", "handler"),
+		errors:    r.Counter("botty_handler_errors_total", "Number of event handlers that failed.", "type", "handler"),
+		timeouts:  r.Counter("botty_handler_timeouts_total", "Number of event handlers that exceeded their timeout.", "type", "handler"),
+		queueSize: r.Gauge("botty_event_queue_depth", "Number of events that are waiting to be handled."),
+	}
+}
+
+var _ brain.MetricsSink = (*BrainMetrics)(nil)
+
+// EventEmitted implements the brain.MetricsSink interface.
+func (m *BrainMetrics) EventEmitted(eventType string) {
+	m.emitted.Inc(eventType)
+}
+
+// EventHandled implements the brain.MetricsSink interface.
+func (m *BrainMetrics) EventHandled(eventType string) {
+	m.handled.Inc(eventType)
+}
+
+// HandlerExecuted implements the brain.MetricsSink interface.
+func (m *BrainMetrics) HandlerExecuted(eventType, handler string, duration time.Duration, err error) {
+	m.latency.Observe(duration.Seconds(), eventType, handler)
+	if err == nil {
+		return
+	}
+
+	m.errors.Inc(eventType, handler)
+	if errors.Is(err, context.DeadlineExceeded) {
+		m.timeouts.Inc(eventType, handler)
+	}
+}
+
+// QueueDepthChanged implements the brain.MetricsSink interface.
+func (m *BrainMetrics) QueueDepthChanged(depth int) {
+	m.queueSize.Set(float64(depth))
+}
+
+// InstrumentAdapter wraps the adapter so that all messages it sends are
+// counted under the given adapter name.
+func InstrumentAdapter(a adapter.Adapter, name string, r *Registry) adapter.Adapter {
+	return &instrumentedAdapter{
+		Adapter: a,
+		name:    name,
+		sent:    r.Counter("botty_adapter_messages_sent_total", "Number of messages that were sent by an adapter.", "adapter"),
+		errors:  r.Counter("botty_adapter_send_errors_total", "Number of messages that an adapter failed to send.", "adapter"),
+	}
+}
+
+type instrumentedAdapter struct {
+	adapter.Adapter
+	name   string
+	sent   *Counter
+	errors *Counter
+}
+
+func (a *instrumentedAdapter) Send(text, channel string) error {
+	err := a.Adapter.Send(text, channel)
+	if err != nil {
+		a.errors.Inc(a.name)
+		return err
+	}
+
+	a.sent.Inc(a.name)
+	return nil
+}
+
+func (a *instrumentedAdapter) Ping(ctx context.Context) error {
+	return adapter.Ping(ctx, a.Adapter)
+}
+
+// StorageMetrics implements the storage.Observer and records the latency of
+// all operations per Memory backend.
+type StorageMetrics struct {
+	latency *Histogram
+	errors  *Counter
+}
+
+// NewStorageMetrics registers all metrics of the storage in the given
+// registry. The result can be passed to Storage.SetObserver.
+func NewStorageMetrics(r *Registry) *StorageMetrics {
+	return &StorageMetrics{
+		latency: r.Histogram("botty_storage_operation_duration_seconds", "Time it took to execute an operation of the memory.", nil, "backend", "operation"),
+		errors:  r.Counter("botty_storage_operation_errors_total", "Number of failed memory operations.", "backend", "operation"),
+	}
+}
+
+// ObserveOperation implements the storage.Observer interface.
+func (m *StorageMetrics) ObserveOperation(backend, operation string, duration time.Duration, err error) {
+	m.latency.Observe(duration.Seconds(), backend, operation)
+	if err != nil {
+		m.errors.Inc(backend, operation)
+	}
+}
@@ -0,0 +1,204 @@
+// Package metrics collects counters, gauges and histograms about the bot and
+// exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets that are used
+// if no other buckets are given. They are meant to measure latencies in
+// seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// A Registry holds all metrics of the bot. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// A family is a metric with all of its label combinations.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64 // only set for histograms
+	series  map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // the value of counters and gauges
+	counts      []uint64 // the number of observations per histogram bucket (not cumulative)
+	sum         float64
+	count       uint64
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// A Counter is a metric that can only increase.
+type Counter struct {
+	registry *Registry
+	family   *family
+}
+
+// A Gauge is a metric that can be set to arbitrary values.
+type Gauge struct {
+	registry *Registry
+	family   *family
+}
+
+// A Histogram counts observations in buckets, e.g. to measure latencies.
+type Histogram struct {
+	registry *Registry
+	family   *family
+}
+
+// Counter returns the counter with the given name and label names. It is
+// created if it does not exist yet. It panics if a metric of another type or
+// with other labels was registered under the same name.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{registry: r, family: r.family(name, help, kindCounter, labels, nil)}
+}
+
+// Gauge returns the gauge with the given name and label names. It is created
+// if it does not exist yet. It panics if a metric of another type or with
+// other labels was registered under the same name.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{registry: r, family: r.family(name, help, kindGauge, labels, nil)}
+}
+
+// Histogram returns the histogram with the given name, buckets and label
+// names. It is created if it does not exist yet. If buckets is empty, the
+// DefaultBuckets are used. It panics if a metric of another type or with other
+// labels was registered under the same name.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &Histogram{registry: r, family: r.family(name, help, kindHistogram, labels, buckets)}
+}
+
+func (r *Registry) family(name, help string, k kind, labels []string, buckets []float64) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.kind != k || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s is already registered as %s with labels %v", name, f.kind, f.labels))
+		}
+		return f
+	}
+
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    k,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	r.families[name] = f
+	return f
+}
+
+// get returns the series of the given label values. The caller must hold the
+// lock of the Registry.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values but got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values. Negative values are
+// ignored because a counter can never decrease.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+
+	c.registry.mu.Lock()
+	c.family.get(labelValues).value += v
+	c.registry.mu.Unlock()
+}
+
+// Value returns the current value of the counter for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.registry.mu.Lock()
+	defer c.registry.mu.Unlock()
+	return c.family.get(labelValues).value
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.registry.mu.Lock()
+	g.family.get(labelValues).value = v
+	g.registry.mu.Unlock()
+}
+
+// Value returns the current value of the gauge for the given label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.registry.mu.Lock()
+	defer g.registry.mu.Unlock()
+	return g.family.get(labelValues).value
+}
+
+// Observe adds a single observation to the histogram for the given label
+// values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.registry.mu.Lock()
+	defer h.registry.mu.Unlock()
+
+	s := h.family.get(labelValues)
+	s.sum += v
+	s.count++
+	for i, bound := range h.family.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+}
+
+// Count returns the number of observations of the histogram for the given
+// label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.registry.mu.Lock()
+	defer h.registry.mu.Unlock()
+	return h.family.get(labelValues).count
+}
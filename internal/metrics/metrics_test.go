@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Number of requests.", "code").Add(3, "200")
+	r.Counter("requests_total", "Number of requests.", "code").Inc(`5"0"0`)
+	r.Gauge("temperature", "").Set(-1.5)
+	h := r.Histogram("latency_seconds", "Request\nlatency.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	out := new(strings.Builder)
+	_, err := r.WriteTo(out)
+	require.NoError(t, err)
+
+	expected := `# HELP latency_seconds Request\nlatency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="5\"0\"0"} 1
+# TYPE temperature gauge
+temperature -1.5
+`
+	assert.Equal(t, expected, out.String())
+
+	assert.Panics(t, func() { r.Gauge("requests_total", "") })
+	assert.Panics(t, func() { r.Counter("requests_total", "", "code").Inc() })
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("up", "").Inc()
+
+	rec := httptest.NewRecorder()
+	NewServer(":0", r).Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# TYPE up counter\nup 1\n", rec.Body.String())
+}
+
+func TestBrainMetrics(t *testing.T) {
+	r := NewRegistry()
+	m := NewBrainMetrics(r)
+	b := brain.New(brain.WithLogger(zaptest.NewLogger(t)), brain.WithMetrics(m))
+
+	b.RegisterHandlerWithOptions(func(evt string) error {
+		return errors.New("failed")
+	}, brain.HandlerOptions{Name: "failing"})
+	b.RegisterHandlerWithOptions(func(ctx context.Context, evt string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, brain.HandlerOptions{Name: "slow", Timeout: time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents()
+		close(done)
+	}()
+
+	_, err := b.EmitAndWait(context.Background(), "hello")
+	assert.Error(t, err)
+	require.NoError(t, b.Shutdown(context.Background()))
+	<-done
+
+	assert.Equal(t, 1.0, m.emitted.Value("string"))
+	assert.Equal(t, 1.0, m.handled.Value("string"))
+	assert.Equal(t, 1.0, m.handled.Value("events.ShutdownEvent"))
+	assert.Equal(t, uint64(1), m.latency.Count("string", "failing"))
+	assert.Equal(t, 1.0, m.errors.Value("string", "failing"))
+	assert.Equal(t, 0.0, m.timeouts.Value("string", "failing"))
+	assert.Equal(t, 1.0, m.timeouts.Value("string", "slow"))
+	assert.Equal(t, 0.0, m.queueSize.Value())
+}
+
+type fakeAdapter struct {
+	err error
+}
+
+func (a *fakeAdapter) RegisterAt(*brain.Brain)   {}
+func (a *fakeAdapter) Send(text, _ string) error { return a.err }
+func (a *fakeAdapter) Close() error              { return nil }
+
+func TestInstrumentAdapter(t *testing.T) {
+	r := NewRegistry()
+	fake := &fakeAdapter{}
+	a := InstrumentAdapter(fake, "fake", r)
+
+	require.NoError(t, a.Send("hello", "general"))
+	fake.err = errors.New("offline")
+	assert.Error(t, a.Send("hello", "general"))
+
+	assert.Equal(t, 1.0, r.Counter("botty_adapter_messages_sent_total", "", "adapter").Value("fake"))
+	assert.Equal(t, 1.0, r.Counter("botty_adapter_send_errors_total", "", "adapter").Value("fake"))
+}
+
+func TestStorageMetrics(t *testing.T) {
+	r := NewRegistry()
+	m := NewStorageMetrics(r)
+	store := storage.NewStorage(zaptest.NewLogger(t))
+	store.SetObserver(m)
+
+	require.NoError(t, store.Set("key", "value"))
+	_, err := store.Get("key", nil)
+	require.NoError(t, err)
+	_, err = store.Get("missing", nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(1), m.latency.Count("InMemory", "set"))
+	assert.Equal(t, uint64(2), m.latency.Count("InMemory", "get"))
+	assert.Equal(t, 0.0, m.errors.Value("InMemory", "get"))
+}
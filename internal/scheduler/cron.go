@@ -0,0 +1,197 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A CronExpr is a parsed cron expression with the five standard fields
+// "minute hour day-of-month month day-of-week". Each field supports "*",
+// single values, ranges ("1-5"), steps ("*/15" or "0-30/10") and lists
+// ("1,15,30"). Months and weekdays may also be given by their three letter
+// English names. Instead of the five fields, one of the descriptors @yearly,
+// @annually, @monthly, @weekly, @daily, @midnight or @hourly can be used.
+type CronExpr struct {
+	minute, hour, dom, month, dow uint64 // bit sets of the allowed values
+	domStar, dowStar              bool   // true if the field was "*"
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = cronField{name: "minute", min: 0, max: 59}
+	hourField   = cronField{name: "hour", min: 0, max: 23}
+	domField    = cronField{name: "day of month", min: 1, max: 31}
+	monthField  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Both 0 and 7 mean Sunday.
+	dowField = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses the given cron expression.
+func ParseCron(expr string) (*CronExpr, error) {
+	spec := strings.TrimSpace(expr)
+	if descriptor, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = descriptor
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have five fields", expr)
+	}
+
+	c := new(CronExpr)
+	var err error
+	for i, target := range []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow} {
+		field := []cronField{minuteField, hourField, domField, monthField, dowField}[i]
+		*target, err = field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+	}
+
+	// Sunday may be given as 0 or 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow = c.dow&^(1<<7) | 1
+	}
+
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+
+	return c, nil
+}
+
+func (f cronField) parse(spec string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(spec, ",") {
+		rangeSpec, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangeSpec = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+			}
+		}
+
+		var low, high int
+		switch {
+		case rangeSpec == "*":
+			low, high = f.min, f.max
+		case strings.Contains(rangeSpec, "-"):
+			i := strings.Index(rangeSpec, "-")
+			var err error
+			if low, err = f.value(rangeSpec[:i]); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(rangeSpec[i+1:]); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if low, err = f.value(rangeSpec); err != nil {
+				return 0, err
+			}
+			high = low
+			if step > 1 {
+				// "5/10" means every ten starting at five
+				high = f.max
+			}
+		}
+
+		if low > high {
+			return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q, must be between %d and %d", f.name, s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Next returns the first time after t that matches the expression. It returns
+// the zero time if there is no such time within the next five years, which can
+// only happen for impossible dates such as February 30th.
+func (c *CronExpr) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !has(c.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !has(c.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !has(c.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// dayMatches implements the usual cron semantics where a day matches if
+// either the day of month or the day of week matches, unless one of them is
+// unrestricted.
+func (c *CronExpr) dayMatches(t time.Time) bool {
+	dom := has(c.dom, t.Day())
+	dow := has(c.dow, int(t.Weekday()))
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2022, time.March, 14, 10, 7, 30, 0, time.UTC) // a Monday
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2022, time.March, 14, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, time.March, 14, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2022, time.March, 15, 9, 0, 0, 0, time.UTC)},
+		{"30 8 1,15 * *", time.Date(2022, time.March, 15, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2022, time.March, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 jan *", time.Date(2023, time.January, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2022, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2022, time.March, 15, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseCron(test.expr)
+		require.NoError(t, err, test.expr)
+		assert.Equal(t, test.next, expr.Next(start), test.expr)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+
+	expr, err := ParseCron("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, expr.Next(time.Now()).IsZero())
+}
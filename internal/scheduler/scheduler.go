@@ -0,0 +1,376 @@
+// Package scheduler emits events into the brain at given times, either once,
+// at fixed intervals or based on cron expressions. All schedules are persisted
+// in the storage.Storage so they survive restarts of the bot.
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/events"
+	"github.com/gillepool/botty/internal/storage"
+	"go.uber.org/zap"
+)
+
+// keyPrefix is prepended to the IDs of all schedules in the storage.
+const keyPrefix = "schedule:"
+
+// The Kind of a Schedule determines how the next time is calculated after the
+// event was emitted.
+type Kind string
+
+const (
+	KindOnce     Kind = "once"
+	KindInterval Kind = "interval"
+	KindCron     Kind = "cron"
+)
+
+// A Schedule emits a single event at the Next time.
+type Schedule struct {
+	ID        string          `json:"id"`
+	Kind      Kind            `json:"kind"`
+	Cron      string          `json:"cron,omitempty"`     // only set for KindCron
+	Interval  time.Duration   `json:"interval,omitempty"` // only set for KindInterval
+	Next      time.Time       `json:"next"`
+	EventType string          `json:"event_type"` // the name that was passed to events.Register
+	Payload   json.RawMessage `json:"payload"`    // the JSON encoded event
+
+	cron *CronExpr
+}
+
+// An Emitter receives the events of the Scheduler. It is implemented by the
+// brain.Brain.
+type Emitter interface {
+	Emit(event interface{}, callbacks ...func(brain.Event))
+}
+
+// The Scheduler emits the events of all schedules when they are due. Events of
+// schedules that were due while the bot was not running are emitted once as
+// soon as the Scheduler is started.
+type Scheduler struct {
+	emitter Emitter
+	store   *storage.Storage
+	logger  *zap.Logger
+	clock   clock.Clock
+
+	mu        sync.Mutex // protects the schedules
+	schedules map[string]*Schedule
+
+	wake    chan struct{} // signals that the schedules changed
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// New creates a Scheduler that emits events via the given Emitter and
+// persists its schedules in the given storage.
+func New(emitter Emitter, store *storage.Storage, logger *zap.Logger) *Scheduler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Scheduler{
+		emitter:   emitter,
+		store:     store,
+		logger:    logger,
+		clock:     clock.New(),
+		schedules: map[string]*Schedule{},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// SetClock replaces the clock that is used to determine when events are due.
+// This is mainly useful in tests to pass a *clock.Mock. It must be called
+// before Start.
+func (s *Scheduler) SetClock(c clock.Clock) {
+	s.mu.Lock()
+	s.clock = c
+	s.mu.Unlock()
+}
+
+// Start loads all persisted schedules and starts emitting their events. The
+// caller must call Stop to release the resources of the Scheduler.
+func (s *Scheduler) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		return errors.New("scheduler was started already")
+	}
+
+	keys, err := s.store.Keys()
+	if err != nil {
+		return fmt.Errorf("failed to load schedules: %w", err)
+	}
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, keyPrefix) {
+			continue
+		}
+
+		sched := new(Schedule)
+		if _, err := s.store.Get(key, sched); err != nil {
+			return fmt.Errorf("failed to load schedule %q: %w", key, err)
+		}
+		if sched.Kind == KindCron {
+			if sched.cron, err = ParseCron(sched.Cron); err != nil {
+				return err
+			}
+		}
+		s.schedules[sched.ID] = sched
+	}
+
+	s.logger.Info("Starting scheduler", zap.Int("schedules", len(s.schedules)))
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.loop()
+
+	return nil
+}
+
+// Stop makes the Scheduler stop emitting events. The schedules remain in the
+// storage so they are continued when the Scheduler is started again.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	stop, stopped := s.stop, s.stopped
+	s.stop = nil
+	s.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-stopped
+}
+
+// After emits the event once after the given delay.
+func (s *Scheduler) After(id string, delay time.Duration, event interface{}) error {
+	return s.At(id, s.now().Add(delay), event)
+}
+
+// At emits the event once at the given time.
+func (s *Scheduler) At(id string, t time.Time, event interface{}) error {
+	return s.add(&Schedule{ID: id, Kind: KindOnce, Next: t}, event)
+}
+
+// Every emits the event repeatedly with the given interval, starting one
+// interval from now.
+func (s *Scheduler) Every(id string, interval time.Duration, event interface{}) error {
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	return s.add(&Schedule{ID: id, Kind: KindInterval, Interval: interval, Next: s.now().Add(interval)}, event)
+}
+
+// Cron emits the event whenever the time matches the given cron expression
+// (see CronExpr).
+func (s *Scheduler) Cron(id, expr string, event interface{}) error {
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return err
+	}
+
+	next := cron.Next(s.now())
+	if next.IsZero() {
+		return fmt.Errorf("cron expression %q never matches", expr)
+	}
+
+	return s.add(&Schedule{ID: id, Kind: KindCron, Cron: expr, Next: next, cron: cron}, event)
+}
+
+// add persists the schedule, replacing any existing schedule with the same ID.
+func (s *Scheduler) add(sched *Schedule, event interface{}) error {
+	if sched.ID == "" {
+		return errors.New("schedule ID must not be empty")
+	}
+
+	var err error
+	sched.EventType, sched.Payload, err = events.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.store.Set(keyPrefix+sched.ID, sched); err != nil {
+		return fmt.Errorf("failed to persist schedule: %w", err)
+	}
+
+	s.schedules[sched.ID] = sched
+	s.notify()
+	return nil
+}
+
+// Cancel removes the schedule with the given ID and reports whether it existed.
+func (s *Scheduler) Cancel(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.schedules[id]
+	delete(s.schedules, id)
+	if _, err := s.store.Delete(keyPrefix + id); err != nil {
+		return ok, err
+	}
+
+	s.notify()
+	return ok, nil
+}
+
+// List returns all schedules ordered by the time of their next event.
+func (s *Scheduler) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Schedule, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		list = append(list, *sched)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Next.Equal(list[j].Next) {
+			return list[i].Next.Before(list[j].Next)
+		}
+		return list[i].ID < list[j].ID
+	})
+
+	return list
+}
+
+func (s *Scheduler) now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clock.Now()
+}
+
+// notify wakes up the loop so it recalculates when the next event is due.
+// The caller must hold the lock.
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) loop() {
+	s.mu.Lock()
+	stop, stopped, clk := s.stop, s.stopped, s.clock
+	s.mu.Unlock()
+	defer close(stopped)
+
+	for {
+		s.emitDue(clk.Now())
+
+		var timer *clock.Timer
+		var timeout <-chan time.Time
+		if next, ok := s.nextTime(); ok {
+			wait := next.Sub(clk.Now())
+			if wait <= 0 {
+				// another schedule became due in the meantime
+				continue
+			}
+			timer = clk.Timer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-timeout:
+		case <-s.wake:
+		case <-stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *Scheduler) nextTime() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next time.Time
+	for _, sched := range s.schedules {
+		if next.IsZero() || sched.Next.Before(next) {
+			next = sched.Next
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// emitDue emits the events of all schedules that are due and then advances or
+// removes the schedules.
+func (s *Scheduler) emitDue(now time.Time) {
+	for _, event := range s.advanceDue(now) {
+		s.emitter.Emit(event)
+	}
+}
+
+// advanceDue returns the events of all schedules that are due and calculates
+// their next time. The events are emitted by the caller without holding the
+// lock because Emitter.Emit may block.
+func (s *Scheduler) advanceDue(now time.Time) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*Schedule
+	for _, sched := range s.schedules {
+		if !sched.Next.After(now) {
+			due = append(due, sched)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Next.Before(due[j].Next)
+	})
+
+	var pending []interface{}
+	for _, sched := range due {
+		event, err := events.Unmarshal(sched.EventType, sched.Payload)
+		if err != nil {
+			s.logger.Error("Failed to decode scheduled event", zap.String("id", sched.ID), zap.Error(err))
+		} else {
+			s.logger.Info("Emitting scheduled event", zap.String("id", sched.ID), zap.String("type", sched.EventType))
+			pending = append(pending, event)
+		}
+
+		switch sched.Kind {
+		case KindInterval:
+			// Skip all runs that were missed while the bot was not running.
+			for !sched.Next.After(now) {
+				sched.Next = sched.Next.Add(sched.Interval)
+			}
+		case KindCron:
+			sched.Next = sched.cron.Next(now)
+		default:
+			sched.Next = time.Time{}
+		}
+
+		if sched.Next.IsZero() {
+			delete(s.schedules, sched.ID)
+			if _, err := s.store.Delete(keyPrefix + sched.ID); err != nil {
+				s.logger.Error("Failed to delete schedule", zap.String("id", sched.ID), zap.Error(err))
+			}
+			continue
+		}
+
+		if err := s.store.Set(keyPrefix+sched.ID, sched); err != nil {
+			s.logger.Error("Failed to persist schedule", zap.String("id", sched.ID), zap.Error(err))
+		}
+	}
+
+	return pending
+}
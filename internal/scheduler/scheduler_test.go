@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/events"
+	"github.com/gillepool/botty/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+type recordingEmitter struct {
+	mu     sync.Mutex
+	events []interface{}
+}
+
+func (e *recordingEmitter) Emit(event interface{}, _ ...func(brain.Event)) {
+	e.mu.Lock()
+	e.events = append(e.events, event)
+	e.mu.Unlock()
+}
+
+func (e *recordingEmitter) take() []interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	events := e.events
+	e.events = nil
+	return events
+}
+
+func newTestScheduler(t *testing.T, store *storage.Storage) (*Scheduler, *recordingEmitter, *clock.Mock) {
+	emitter := new(recordingEmitter)
+	s := New(emitter, store, zaptest.NewLogger(t))
+	mock := clock.NewMock()
+	mock.Set(time.Date(2022, time.March, 14, 10, 0, 0, 0, time.UTC))
+	s.SetClock(mock)
+	return s, emitter, mock
+}
+
+func TestSchedulerKinds(t *testing.T) {
+	s, emitter, mock := newTestScheduler(t, storage.NewStorage(zaptest.NewLogger(t)))
+
+	require.NoError(t, s.After("once", 90*time.Second, events.ReceiveMessageEvent{Text: "once"}))
+	require.NoError(t, s.Every("interval", time.Minute, events.ReceiveMessageEvent{Text: "interval"}))
+	require.NoError(t, s.Cron("cron", "*/5 * * * *", events.ReceiveMessageEvent{Text: "cron"}))
+
+	mock.Add(time.Minute)
+	s.emitDue(mock.Now())
+	assert.Equal(t, []interface{}{events.ReceiveMessageEvent{Text: "interval"}}, emitter.take())
+
+	mock.Add(time.Minute)
+	s.emitDue(mock.Now())
+	assert.Equal(t, []interface{}{
+		events.ReceiveMessageEvent{Text: "once"},
+		events.ReceiveMessageEvent{Text: "interval"},
+	}, emitter.take())
+
+	// skipped intervals are not emitted more than once
+	mock.Add(3 * time.Minute)
+	s.emitDue(mock.Now())
+	assert.ElementsMatch(t, []interface{}{
+		events.ReceiveMessageEvent{Text: "interval"},
+		events.ReceiveMessageEvent{Text: "cron"},
+	}, emitter.take())
+
+	ids := []string{}
+	for _, sched := range s.List() {
+		ids = append(ids, sched.ID)
+	}
+	assert.Equal(t, []string{"interval", "cron"}, ids)
+
+	ok, err := s.Cancel("interval")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Len(t, s.List(), 1)
+}
+
+func TestSchedulerRestoresPersistedSchedules(t *testing.T) {
+	store := storage.NewStorage(zaptest.NewLogger(t))
+
+	s, _, mock := newTestScheduler(t, store)
+	require.NoError(t, s.After("reminder", time.Hour, events.ReceiveMessageEvent{Text: "standup"}))
+
+	// a new scheduler is started after the reminder was due
+	restarted, emitter, _ := newTestScheduler(t, store)
+	restarted.SetClock(mock)
+	mock.Add(2 * time.Hour)
+
+	require.NoError(t, restarted.Start())
+	defer restarted.Stop()
+
+	require.Eventually(t, func() bool {
+		emitter.mu.Lock()
+		defer emitter.mu.Unlock()
+		return len(emitter.events) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []interface{}{events.ReceiveMessageEvent{Text: "standup"}}, emitter.take())
+
+	keys, err := store.Keys()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
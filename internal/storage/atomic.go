@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// maxUpdateAttempts is the number of times Storage.Update tries to write a
+// value before it gives up because other writers keep changing it.
+const maxUpdateAttempts = 10
+
+// ErrConflict is returned by Storage.Update if the value was changed by other
+// writers in each attempt to update it.
+var ErrConflict = errors.New("value was modified concurrently")
+
+// An AtomicMemory is a Memory that supports atomic updates, even if several
+// processes share the same backend.
+type AtomicMemory interface {
+	Memory
+
+	// CompareAndSwap sets the key to new if its current value is old. A nil
+	// old value means that the key must not exist. It returns false if the
+	// value was not changed.
+	CompareAndSwap(key string, old, new []byte) (bool, error)
+
+	// Increment adds delta to the integer value of the key and returns the
+	// result. A missing key is treated as zero.
+	Increment(key string, delta int64) (int64, error)
+}
+
+// Update atomically modifies the value of the key. The current value is
+// decoded into value, which must be a pointer, and fn is called to modify it.
+// The exists argument of fn reports whether the key was set. If fn returns an
+// error, the update is aborted and the error is returned.
+//
+// If the Memory implements the AtomicMemory interface, the new value is only
+// written if nobody else changed the key in the meantime. Otherwise fn is
+// called again with the new value. Updates through the same Storage never
+// conflict because the Storage is locked while fn is executed, so fn must not
+// use the Storage itself.
+func (s *Storage) Update(key string, value interface{}, fn func(exists bool) error) error {
+	return s.UpdateContext(context.Background(), key, value, fn)
+}
+
+// UpdateContext is like Update but records the operations as child spans of
+// the span in the context (see package tracing).
+func (s *Storage) UpdateContext(ctx context.Context, key string, value interface{}, fn func(exists bool) error) error {
+	target := reflect.ValueOf(value)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return fmt.Errorf("update of %q needs a non-nil pointer but got %T", key, value)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	memory, isAtomic := as[AtomicMemory](s.memory)
+	if !isAtomic {
+		ok, err := s.get(ctx, key, value)
+		if err != nil {
+			return err
+		}
+		if err := fn(ok); err != nil {
+			return err
+		}
+		return s.set(ctx, key, value)
+	}
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		done := s.operation(ctx, "get", key)
+		old, ok, err := memory.Get(key)
+		done(err)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch value %w ", err)
+		}
+
+		target.Elem().Set(reflect.Zero(target.Elem().Type()))
+		if ok {
+			if err := s.encoder.Decode(old, value); err != nil {
+				return &DecodeError{Key: key, Type: target.Elem().Type(), Err: err}
+			}
+		} else {
+			old = nil
+		}
+
+		if err := fn(ok); err != nil {
+			return err
+		}
+
+		data, err := s.encoder.Encode(value)
+		if err != nil {
+			return &EncodeError{Key: key, Type: target.Elem().Type(), Err: err}
+		}
+		if ok && bytes.Equal(old, data) {
+			return nil
+		}
+
+		done = s.operation(ctx, "compare_and_swap", key)
+		swapped, err := memory.CompareAndSwap(key, old, data)
+		done(err)
+		if err != nil || swapped {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to update %q after %d attempts: %w", key, maxUpdateAttempts, ErrConflict)
+}
+
+// Increment atomically adds delta to the integer value of the key and returns
+// the result. The value is stored as decimal string, which the default JSON
+// encoder decodes as number. If the Memory does not implement the
+// AtomicMemory interface, the increment is only atomic within this Storage.
+func (s *Storage) Increment(key string, delta int64) (int64, error) {
+	return s.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is like Increment but records the operation as child span
+// of the span in the context (see package tracing).
+func (s *Storage) IncrementContext(ctx context.Context, key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	done := s.operation(ctx, "increment", key)
+	n, err := s.increment(key, delta)
+	done(err)
+	return n, err
+}
+
+func (s *Storage) increment(key string, delta int64) (int64, error) {
+	if memory, ok := as[AtomicMemory](s.memory); ok {
+		return memory.Increment(key, delta)
+	}
+
+	data, ok, err := s.memory.Get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := addInt(key, data, ok, delta)
+	if err != nil {
+		return 0, err
+	}
+	return n, s.memory.Set(key, []byte(strconv.FormatInt(n, 10)))
+}
+
+// addInt parses the current value of the key as integer and adds delta.
+func addInt(key string, data []byte, exists bool, delta int64) (int64, error) {
+	if !exists {
+		return delta, nil
+	}
+
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %q is not an integer: %w", key, err)
+	}
+	return n + delta, nil
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrTransactionsNotSupported is returned by Storage.Batch if the Memory does
+// not implement the TransactionalMemory interface.
+var ErrTransactionsNotSupported = errors.New("memory does not support transactions")
+
+// A MemoryTx reads and writes keys within a transaction of a
+// TransactionalMemory. Reads include the changes of the transaction itself.
+type MemoryTx interface {
+	Set(key string, value []byte) error
+	Get(key string) ([]byte, bool, error)
+	Delete(key string) (bool, error)
+}
+
+// A TransactionalMemory is a Memory that can apply several changes atomically.
+type TransactionalMemory interface {
+	Memory
+
+	// Transaction calls fn and applies all changes that fn made through the
+	// MemoryTx atomically once it returns nil. If fn returns an error, no
+	// changes are applied and the error is returned.
+	Transaction(fn func(tx MemoryTx) error) error
+}
+
+// A Tx is a transaction of Storage.Batch. Its methods work like the methods
+// of the Storage with the same name.
+type Tx struct {
+	storage *Storage
+	tx      MemoryTx
+}
+
+func (tx *Tx) Set(key string, value interface{}) error {
+	data, err := tx.storage.encode(key, value)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Set(key, data)
+}
+
+func (tx *Tx) Get(key string, value interface{}) (bool, error) {
+	data, ok, err := tx.tx.Get(key)
+	if err != nil || !ok || value == nil {
+		return ok, err
+	}
+
+	if err := tx.storage.decode(key, data, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (tx *Tx) Delete(key string) (bool, error) {
+	return tx.tx.Delete(key)
+}
+
+// Batch calls fn with a transaction and atomically applies all changes that
+// fn made through it once fn returns nil, e.g. to rename a key without losing
+// it if the bot crashes in between. If fn returns an error, nothing is changed
+// and the error is returned. Keys that are set in the transaction lose their
+// TTL.
+//
+// Some backends call fn again if other processes changed the data in the
+// meantime, so fn should not have side effects. Like for Update, fn must not
+// use the Storage itself. If the Memory does not implement the
+// TransactionalMemory interface, ErrTransactionsNotSupported is returned.
+func (s *Storage) Batch(fn func(tx *Tx) error) error {
+	return s.BatchContext(context.Background(), fn)
+}
+
+// BatchContext is like Batch but records the transaction as child span of the
+// span in the context (see package tracing).
+func (s *Storage) BatchContext(ctx context.Context, fn func(tx *Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	memory, ok := as[TransactionalMemory](s.memory)
+	if !ok {
+		return ErrTransactionsNotSupported
+	}
+
+	done := s.operation(ctx, "batch", "")
+	err := memory.Transaction(func(tx MemoryTx) error {
+		return fn(&Tx{storage: s, tx: tx})
+	})
+	done(err)
+	return err
+}
+
+// A bufferedTx keeps the changes of a transaction in a private copy until the
+// Memory applies them on commit. Reads fall back to the Memory for keys that
+// were not changed.
+type bufferedTx struct {
+	read    func(key string) ([]byte, bool, error)
+	changes map[string][]byte // nil for deleted keys
+	order   []string          // changed keys in the order of their first change
+}
+
+func newBufferedTx(read func(key string) ([]byte, bool, error)) *bufferedTx {
+	return &bufferedTx{read: read, changes: map[string][]byte{}}
+}
+
+func (tx *bufferedTx) Set(key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	tx.change(key, value)
+	return nil
+}
+
+func (tx *bufferedTx) Get(key string) ([]byte, bool, error) {
+	if value, ok := tx.changes[key]; ok {
+		return value, value != nil, nil
+	}
+	return tx.read(key)
+}
+
+func (tx *bufferedTx) Delete(key string) (bool, error) {
+	_, ok, err := tx.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	tx.change(key, nil)
+	return ok, nil
+}
+
+func (tx *bufferedTx) change(key string, value []byte) {
+	if _, ok := tx.changes[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	tx.changes[key] = value
+}
+
+// each calls fn for all changes in order. The value is nil if the key was
+// deleted.
+func (tx *bufferedTx) each(fn func(key string, value []byte)) {
+	for _, key := range tx.order {
+		fn(key, tx.changes[key])
+	}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// rename moves the value of a key to another key in a single transaction.
+func rename(store *Storage, from, to string) error {
+	return store.Batch(func(tx *Tx) error {
+		var value string
+		ok, err := tx.Get(from, &value)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNotFound
+		}
+
+		if _, err := tx.Delete(from); err != nil {
+			return err
+		}
+		return tx.Set(to, value)
+	})
+}
+
+// testStorageBatch checks the transactions of the Memory of the store.
+func testStorageBatch(t *testing.T, store *Storage) {
+	require.NoError(t, store.Set("x", "hello"))
+	require.NoError(t, rename(store, "x", "y"))
+
+	ok, err := store.Get("x", nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	value, err := GetAs[string](store, "y")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", value)
+
+	// the transaction sees its own changes but nobody else does if it fails
+	failed := errors.New("failed")
+	err = store.Batch(func(tx *Tx) error {
+		require.NoError(t, tx.Set("z", "world"))
+		var value string
+		ok, err := tx.Get("z", &value)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "world", value)
+
+		ok, err = tx.Delete("y")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+
+	keys, err := store.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"y"}, keys)
+}
+
+func TestInMemoryBatch(t *testing.T) {
+	testStorageBatch(t, NewStorage(zaptest.NewLogger(t)))
+}
+
+func TestFileMemoryBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+	memory, err := OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+
+	store := NewStorage(zaptest.NewLogger(t))
+	store.SetMemory(memory)
+	testStorageBatch(t, store)
+	require.NoError(t, store.Close())
+
+	// the committed transaction survives a restart
+	memory, err = OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	defer memory.Close()
+
+	keys, err := memory.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"y"}, keys)
+}
+
+func TestNamespaceBatch(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+	testStorageBatch(t, store.Namespace("quotes"))
+
+	keys, err := store.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"quotes:y"}, keys)
+}
+
+func TestStorageBatchNotSupported(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+	store.SetMemory(plainMemory{NewInMemory(clock.New())})
+
+	assert.ErrorIs(t, rename(store, "x", "y"), ErrTransactionsNotSupported)
+	assert.ErrorIs(t, rename(store.Namespace("quotes"), "x", "y"), ErrTransactionsNotSupported)
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// An Encoding identifies a MemoryEncoder in the envelope of the
+// VersionedEncoder. The values must never change because they are stored.
+type Encoding byte
+
+const (
+	EncodingJSON    Encoding = 1
+	EncodingGob     Encoding = 2
+	EncodingMsgPack Encoding = 3
+	EncodingProto   Encoding = 4
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingJSON:
+		return "json"
+	case EncodingGob:
+		return "gob"
+	case EncodingMsgPack:
+		return "msgpack"
+	case EncodingProto:
+		return "proto"
+	default:
+		return fmt.Sprintf("Encoding(%d)", byte(e))
+	}
+}
+
+// encoder returns the MemoryEncoder of the encoding or nil if it is unknown.
+func (e Encoding) encoder() MemoryEncoder {
+	switch e {
+	case EncodingJSON:
+		return NewJSONEncoder()
+	case EncodingGob:
+		return NewGobEncoder()
+	case EncodingMsgPack:
+		return NewMsgPackEncoder()
+	case EncodingProto:
+		return NewProtoEncoder()
+	default:
+		return nil
+	}
+}
+
+// NewJSONEncoder returns the MemoryEncoder that is used by default.
+func NewJSONEncoder() MemoryEncoder {
+	return new(jsonEncoder)
+}
+
+type gobEncoder struct{}
+
+// NewGobEncoder returns a MemoryEncoder that uses encoding/gob. Values that
+// are stored as interface must be registered with gob.Register.
+func NewGobEncoder() MemoryEncoder {
+	return new(gobEncoder)
+}
+
+func (gobEncoder) Encode(value interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(value)
+	return buf.Bytes(), err
+}
+
+func (gobEncoder) Decode(data []byte, target interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(target)
+}
+
+// A ProtoMarshaler is a value that can be encoded by the protobuf encoder,
+// e.g. a message that was generated by gogoproto.
+type ProtoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// A ProtoUnmarshaler is a value that can be decoded by the protobuf encoder.
+type ProtoUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+type protoEncoder struct{}
+
+// NewProtoEncoder returns a MemoryEncoder that stores values in the protobuf
+// wire format. It relies on the Marshal and Unmarshal methods of the values,
+// so it only accepts ProtoMarshaler values and ProtoUnmarshaler targets.
+func NewProtoEncoder() MemoryEncoder {
+	return new(protoEncoder)
+}
+
+func (protoEncoder) Encode(value interface{}) ([]byte, error) {
+	m, ok := value.(ProtoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", value)
+	}
+	return m.Marshal()
+}
+
+func (protoEncoder) Decode(data []byte, target interface{}) error {
+	m, ok := target.(ProtoUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message", target)
+	}
+	return m.Unmarshal(data)
+}
+
+// envelopeMagic starts every value of the VersionedEncoder. Valid JSON never
+// starts with these bytes, so values without envelope can be detected.
+var envelopeMagic = []byte{0xb0, 0x77}
+
+// ErrNewerSchema is returned by the VersionedEncoder if a value was stored
+// with a schema version that is newer than the version that it knows.
+var ErrNewerSchema = errors.New("value has a newer schema version")
+
+// An Upgrade migrates a value from one schema version to the next. It decodes
+// the old value with decode, e.g. into the struct that was stored before, and
+// returns the value in the shape of the next version.
+type Upgrade func(decode func(old interface{}) error) (interface{}, error)
+
+// A VersionedEncoder wraps the values of a MemoryEncoder in an envelope that
+// contains the Encoding and the schema version of the type of the value. The
+// schema version of a type is the number of upgrades that were registered for
+// it, so changing the shape of a stored type only requires an upgrade from
+// the previous shape. Old values are upgraded when they are read, and values
+// that were stored with another Encoding can still be read.
+//
+// Values without envelope, i.e. values stored by the default JSON encoder,
+// are decoded as JSON with schema version zero.
+type VersionedEncoder struct {
+	encoding Encoding
+	encoder  MemoryEncoder
+
+	mu       sync.RWMutex
+	upgrades map[reflect.Type][]Upgrade
+}
+
+// NewVersionedEncoder returns a VersionedEncoder that encodes new values with
+// the given Encoding.
+func NewVersionedEncoder(encoding Encoding) *VersionedEncoder {
+	encoder := encoding.encoder()
+	if encoder == nil {
+		panic(fmt.Sprintf("unknown encoding %v", encoding))
+	}
+
+	return &VersionedEncoder{
+		encoding: encoding,
+		encoder:  encoder,
+		upgrades: map[reflect.Type][]Upgrade{},
+	}
+}
+
+// RegisterUpgrade registers the upgrade of the type of the example value from
+// the schema version from to the next version. The upgrades of a type must be
+// registered in order, starting at version zero.
+func (e *VersionedEncoder) RegisterUpgrade(example interface{}, from int, upgrade Upgrade) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	typ := baseType(reflect.TypeOf(example))
+	if from != len(e.upgrades[typ]) {
+		panic(fmt.Sprintf("upgrade of %v from version %d must be registered after the upgrade from version %d", typ, from, len(e.upgrades[typ])))
+	}
+	e.upgrades[typ] = append(e.upgrades[typ], upgrade)
+}
+
+// Version returns the current schema version of the type of the value.
+func (e *VersionedEncoder) Version(value interface{}) int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.upgrades[baseType(reflect.TypeOf(value))])
+}
+
+func (e *VersionedEncoder) Encode(value interface{}) ([]byte, error) {
+	payload, err := e.encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	data := append([]byte{}, envelopeMagic...)
+	data = append(data, byte(e.encoding))
+	data = binary.AppendUvarint(data, uint64(e.Version(value)))
+	return append(data, payload...), nil
+}
+
+// Decode decodes the value and upgrades it to the current schema version of
+// the type of the target.
+func (e *VersionedEncoder) Decode(data []byte, target interface{}) error {
+	encoding, version, payload, err := openEnvelope(data)
+	if err != nil {
+		return err
+	}
+
+	encoder := encoding.encoder()
+	if encoder == nil {
+		return fmt.Errorf("unknown encoding %v", encoding)
+	}
+
+	e.mu.RLock()
+	upgrades := e.upgrades[baseType(reflect.TypeOf(target))]
+	e.mu.RUnlock()
+
+	switch {
+	case version == len(upgrades):
+		return encoder.Decode(payload, target)
+	case version > len(upgrades):
+		return fmt.Errorf("%w: version %d is newer than %d", ErrNewerSchema, version, len(upgrades))
+	}
+
+	for _, upgrade := range upgrades[version:] {
+		value, err := upgrade(func(old interface{}) error {
+			return encoder.Decode(payload, old)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upgrade from version %d: %w", version, err)
+		}
+
+		// The upgraded value is encoded again, so the next upgrade or the
+		// caller can decode it like a stored value.
+		if payload, err = e.encoder.Encode(value); err != nil {
+			return fmt.Errorf("failed to encode upgraded value of version %d: %w", version+1, err)
+		}
+		encoder = e.encoder
+		version++
+	}
+
+	return encoder.Decode(payload, target)
+}
+
+// openEnvelope returns the contents of the envelope. Data without envelope is
+// JSON with schema version zero.
+func openEnvelope(data []byte) (Encoding, int, []byte, error) {
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		return EncodingJSON, 0, data, nil
+	}
+
+	data = data[len(envelopeMagic):]
+	if len(data) == 0 {
+		return 0, 0, nil, errors.New("envelope is truncated")
+	}
+
+	encoding := Encoding(data[0])
+	version, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return 0, 0, nil, errors.New("envelope has an invalid schema version")
+	}
+	return encoding, int(version), data[1+n:], nil
+}
+
+// baseType returns the type that pointers point to, so that values and
+// decoding targets share the same schema version.
+func baseType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
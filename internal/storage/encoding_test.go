@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+type quote struct {
+	Text   string
+	Author string
+	Tags   []string
+	Votes  int64
+	Score  float64
+	Hidden bool
+	Extra  map[string]interface{}
+}
+
+// protoQuote is a fake protobuf message that stores its text with a length
+// prefix like field one of the wire format.
+type protoQuote struct {
+	Text string
+}
+
+func (q *protoQuote) Marshal() ([]byte, error) {
+	data := []byte{0x0a}
+	data = binary.AppendUvarint(data, uint64(len(q.Text)))
+	return append(data, q.Text...), nil
+}
+
+func (q *protoQuote) Unmarshal(data []byte) error {
+	if len(data) == 0 || data[0] != 0x0a {
+		return errors.New("unexpected field")
+	}
+	n, l := binary.Uvarint(data[1:])
+	q.Text = string(data[1+l : 1+l+int(n)])
+	return nil
+}
+
+func TestEncoders(t *testing.T) {
+	value := quote{
+		Text:   "hello",
+		Author: "alice",
+		Tags:   []string{"a", "b"},
+		Votes:  -1 << 40,
+		Score:  0.5,
+		Hidden: true,
+		Extra:  map[string]interface{}{"nested": []interface{}{nil, "x", 300.0}},
+	}
+
+	for _, encoding := range []Encoding{EncodingJSON, EncodingGob, EncodingMsgPack} {
+		t.Run(encoding.String(), func(t *testing.T) {
+			if encoding == EncodingGob {
+				value.Extra = nil // gob does not support nil interface values
+			}
+
+			store := NewStorage(zaptest.NewLogger(t))
+			store.SetMemoryEncoder(NewVersionedEncoder(encoding))
+			require.NoError(t, store.Set("quote", value))
+
+			decoded, err := GetAs[quote](store, "quote")
+			require.NoError(t, err)
+			assert.Equal(t, value, decoded)
+		})
+	}
+
+	t.Run("proto", func(t *testing.T) {
+		store := NewStorage(zaptest.NewLogger(t))
+		store.SetMemoryEncoder(NewVersionedEncoder(EncodingProto))
+		require.NoError(t, store.Set("quote", &protoQuote{Text: "hello"}))
+
+		decoded, err := GetAs[protoQuote](store, "quote")
+		require.NoError(t, err)
+		assert.Equal(t, "hello", decoded.Text)
+
+		assert.Error(t, store.Set("quote", "not a message"))
+	})
+}
+
+func TestMsgPackFormat(t *testing.T) {
+	type tagged struct {
+		Name  string `msgpack:"name"`
+		Skip  int    `msgpack:"-"`
+		Empty string `json:"empty,omitempty"`
+	}
+
+	// byte sequences from the MessagePack specification
+	tests := []struct {
+		name  string
+		value interface{}
+		data  []byte
+	}{
+		{"map", map[string]interface{}{"b": []interface{}{int64(1), int64(-1), uint64(200)}, "a": "x"}, []byte{0x82, 0xa1, 'a', 0xa1, 'x', 0xa1, 'b', 0x93, 0x01, 0xff, 0xcc, 0xc8}},
+		{"nil", nil, []byte{0xc0}},
+		{"bool", true, []byte{0xc3}},
+		{"int8", -33, []byte{0xd0, 0xdf}},
+		{"uint16", 256, []byte{0xcd, 0x01, 0x00}},
+		{"uint64", uint64(1 << 32), []byte{0xcf, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}},
+		{"int64", int64(-1 << 40), []byte{0xd3, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"float32", float32(1.5), []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}},
+		{"float64", 0.5, []byte{0xcb, 0x3f, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"inf", math.Inf(-1), []byte{0xcb, 0xff, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"str8", strings.Repeat("a", 32), append([]byte{0xd9, 0x20}, strings.Repeat("a", 32)...)},
+		{"bin", []byte{1, 2}, []byte{0xc4, 0x02, 0x01, 0x02}},
+		{"bin array", [4]byte{1, 2, 3, 4}, []byte{0xc4, 0x04, 0x01, 0x02, 0x03, 0x04}},
+		{"timestamp32", time.Unix(1, 0), []byte{0xd6, 0xff, 0x00, 0x00, 0x00, 0x01}},
+		{"timestamp64", time.Unix(1, 1), []byte{0xd7, 0xff, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x01}},
+		{"timestamp96", time.Unix(-1, 0), []byte{0xc7, 0x0c, 0xff, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"struct", tagged{Name: "x"}, []byte{0x81, 0xa4, 'n', 'a', 'm', 'e', 0xa1, 'x'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := NewMsgPackEncoder().Encode(tt.value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.data, data)
+
+			target := reflect.New(reflect.TypeOf(&tt.value).Elem())
+			if tt.value != nil {
+				target = reflect.New(reflect.TypeOf(tt.value))
+			}
+			require.NoError(t, NewMsgPackEncoder().Decode(data, target.Interface()))
+			assert.Equal(t, tt.value, target.Elem().Interface())
+		})
+	}
+
+	data, err := NewMsgPackEncoder().Encode(tagged{Name: "x", Skip: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x81, 0xa4, 'n', 'a', 'm', 'e', 0xa1, 'x'}, data)
+
+	var nan float64
+	require.NoError(t, NewMsgPackEncoder().Decode([]byte{0xcb, 0x7f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, &nan))
+	assert.True(t, math.IsNaN(nan))
+
+	// binary and unsigned values written by other implementations
+	var decoded struct {
+		Data []byte
+		N    uint64
+	}
+	data = []byte{0x82, 0xa4, 'D', 'a', 't', 'a', 0xc4, 0x02, 0x01, 0x02, 0xa1, 'N', 0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	require.NoError(t, NewMsgPackEncoder().Decode(data, &decoded))
+	assert.Equal(t, []byte{1, 2}, decoded.Data)
+	assert.Equal(t, uint64(1<<64-1), decoded.N)
+
+	// fixed size IDs and hashes
+	type hashed struct {
+		ID   [16]byte
+		Hash [32]byte
+	}
+	value := hashed{ID: [16]byte{1, 2, 3}, Hash: [32]byte{31: 0xff}}
+	data, err = NewMsgPackEncoder().Encode(value)
+	require.NoError(t, err)
+	var hashes hashed
+	require.NoError(t, NewMsgPackEncoder().Decode(data, &hashes))
+	assert.Equal(t, value, hashes)
+
+	// interfaces get 64 bit numbers and strings like with encoding/json
+	var generic interface{}
+	data = []byte{0x94, 0xff, 0xcc, 0xc8, 0xc4, 0x01, 'x', 0xd6, 0xff, 0x00, 0x00, 0x00, 0x01}
+	require.NoError(t, NewMsgPackEncoder().Decode(data, &generic))
+	assert.Equal(t, []interface{}{int64(-1), uint64(200), "x", time.Unix(1, 0)}, generic)
+
+	var small int8
+	assert.Error(t, NewMsgPackEncoder().Decode([]byte{0xa1, 'x'}, &small))
+	assert.Error(t, NewMsgPackEncoder().Decode([]byte{0x92, 0x01}, &decoded))
+	assert.Error(t, NewMsgPackEncoder().Decode([]byte{0x01, 0x02}, &small))
+}
+
+type karmaV0 struct {
+	Points int
+}
+
+type karmaV1 struct {
+	Points int
+	Name   string
+}
+
+type karma struct {
+	Score int
+	Name  string
+}
+
+func TestVersionedEncoderUpgrades(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+
+	// stored before versioning was introduced
+	require.NoError(t, store.Set("alice", karmaV0{Points: 1}))
+
+	encoder := NewVersionedEncoder(EncodingMsgPack)
+	encoder.RegisterUpgrade(karma{}, 0, func(decode func(interface{}) error) (interface{}, error) {
+		var old karmaV0
+		err := decode(&old)
+		return karmaV1{Points: old.Points, Name: "unknown"}, err
+	})
+	encoder.RegisterUpgrade(karma{}, 1, func(decode func(interface{}) error) (interface{}, error) {
+		var old karmaV1
+		err := decode(&old)
+		return karma{Score: old.Points, Name: old.Name}, err
+	})
+	assert.Equal(t, 2, encoder.Version(&karma{}))
+	assert.Panics(t, func() { encoder.RegisterUpgrade(karma{}, 5, nil) })
+
+	store.SetMemoryEncoder(encoder)
+
+	value, err := GetAs[karma](store, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, karma{Score: 1, Name: "unknown"}, value)
+
+	// values stored with another encoding and an older version are upgraded,
+	// here by an older bot in which the type still had the shape of version 1
+	gob := NewVersionedEncoder(EncodingGob)
+	gob.RegisterUpgrade(karmaV1{}, 0, nil)
+	store.SetMemoryEncoder(gob)
+	require.NoError(t, store.Set("bob", karmaV1{Points: 2, Name: "bob"}))
+
+	store.SetMemoryEncoder(encoder)
+	value, err = GetAs[karma](store, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, karma{Score: 2, Name: "bob"}, value)
+
+	// current values are decoded as they are
+	require.NoError(t, store.Set("carol", karma{Score: 3, Name: "carol"}))
+	value, err = GetAs[karma](store, "carol")
+	require.NoError(t, err)
+	assert.Equal(t, karma{Score: 3, Name: "carol"}, value)
+
+	// values from the future are rejected
+	store.SetMemoryEncoder(NewVersionedEncoder(EncodingJSON))
+	_, err = GetAs[karmaV0](store, "carol")
+	assert.ErrorIs(t, err, ErrNewerSchema)
+}
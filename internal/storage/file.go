@@ -0,0 +1,514 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// ErrLocked is returned by OpenFileMemory if another process uses the file.
+var ErrLocked = errors.New("file is locked by another process")
+
+// minCompactRecords is the minimum number of records in the log before it is
+// compacted. Smaller logs are never compacted because it is not worth it.
+const minCompactRecords = 1024
+
+// maxRecordSize limits the payload of a record, so a corrupt length in the log
+// cannot make us allocate gigabytes of memory.
+const maxRecordSize = 64 << 20
+
+// Operations of the records in the log.
+const (
+	opSet    byte = 1
+	opDelete byte = 2
+	opBatch  byte = 3 // the value contains the records of a transaction
+)
+
+// FileMemory is a persistent Memory that stores all data in a single file.
+// The file is an append-only log of all changes which is replayed on startup
+// and compacted once it contains mostly outdated records. Every change is
+// written with fsync before it becomes visible, and compaction replaces the
+// file via atomic rename, so the data survives crashes. A lock file prevents
+// two processes from opening the same file.
+//
+// FileMemory implements the AtomicMemory, the ExpiringMemory and the
+// TransactionalMemory interface.
+type FileMemory struct {
+	mu      sync.Mutex // serializes all changes to the file
+	path    string
+	file    *os.File
+	lock    *fileLock
+	index   *InMemory // all data that is currently stored
+	records int       // number of records in the log
+	size    int64     // size of the log, new records are written at this offset
+	failed  error     // set if a failed write could not be undone
+}
+
+// OpenFileMemory opens the file at the given path or creates it if it does not
+// exist. The clock is used to expire keys. If the last record of the file is
+// incomplete, e.g. because the process crashed while writing it, the record is
+// discarded. Any other corrupt record makes OpenFileMemory fail without
+// changing the file, so no valid records after it are lost.
+func OpenFileMemory(path string, clk clock.Clock) (*FileMemory, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	m := &FileMemory{
+		path:  path,
+		lock:  lock,
+		index: NewInMemory(clk),
+	}
+
+	// A leftover temporary file means that we crashed while compacting, so
+	// the original file is still complete.
+	_ = os.Remove(path + ".tmp")
+
+	if err := m.load(); err != nil {
+		lock.unlock()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// load replays the log into the index and opens the file for appending.
+func (m *FileMemory) load() error {
+	f, err := os.OpenFile(m.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open memory file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open memory file: %w", err)
+	}
+
+	valid, err := m.replay(bufio.NewReader(f), info.Size())
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Discard an incomplete record at the end of the file.
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to truncate memory file: %w", err)
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	m.file = f
+	m.size = valid
+	return nil
+}
+
+// replay applies all complete records of the log with the given size and
+// returns the size of its valid part. Only the last record may be torn, i.e.
+// the file ends within it or right after its corrupt payload. Corrupt records
+// before the end of the file are reported as error.
+func (m *FileMemory) replay(r io.Reader, size int64) (int64, error) {
+	var valid int64
+	for {
+		rec, n, err := readRecord(r)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return valid, nil
+		case errors.Is(err, errCorruptRecord) && valid+n >= size:
+			return valid, nil
+		case err != nil:
+			return 0, fmt.Errorf("failed to read memory file at offset %d: %w", valid, err)
+		}
+
+		if err := m.apply(rec); err != nil {
+			return 0, fmt.Errorf("failed to replay memory file at offset %d: %w", valid, err)
+		}
+
+		valid += n
+		m.records++
+	}
+}
+
+// apply changes the index according to the record.
+func (m *FileMemory) apply(rec record) error {
+	switch rec.op {
+	case opSet:
+		m.index.setUntil(rec.key, rec.value, rec.expires)
+	case opDelete:
+		_, _ = m.index.Delete(rec.key)
+	case opBatch:
+		// The records of a transaction are only applied together.
+		var batch []record
+		r := bytes.NewReader(rec.value)
+		for r.Len() > 0 {
+			nested, _, err := readRecord(r)
+			if err != nil {
+				return errCorruptRecord
+			}
+			batch = append(batch, nested)
+		}
+		for _, nested := range batch {
+			if err := m.apply(nested); err != nil {
+				return err
+			}
+		}
+	default:
+		return errCorruptRecord
+	}
+	return nil
+}
+
+func (m *FileMemory) Set(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.append(record{op: opSet, key: key, value: value}); err != nil {
+		return err
+	}
+
+	m.index.setUntil(key, value, time.Time{})
+	return m.compactIfNeeded()
+}
+
+// SetWithTTL stores the value until the TTL has passed.
+func (m *FileMemory) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expires := m.index.clock.Now().Add(ttl)
+	if err := m.append(record{op: opSet, key: key, value: value, expires: expires}); err != nil {
+		return err
+	}
+
+	m.index.setUntil(key, value, expires)
+	return m.compactIfNeeded()
+}
+
+func (m *FileMemory) Get(key string) ([]byte, bool, error) {
+	return m.index.Get(key)
+}
+
+func (m *FileMemory) Delete(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok, _ := m.index.Get(key); !ok {
+		return false, nil
+	}
+
+	if err := m.append(record{op: opDelete, key: key}); err != nil {
+		return false, err
+	}
+
+	_, _ = m.index.Delete(key)
+	return true, m.compactIfNeeded()
+}
+
+func (m *FileMemory) Keys() ([]string, error) {
+	return m.index.Keys()
+}
+
+func (m *FileMemory) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	return m.index.Scan(prefix, cursor, limit)
+}
+
+// CompareAndSwap sets the key to new if its current value is old. A nil old
+// value means that the key must not exist. The TTL of the key is removed.
+func (m *FileMemory) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists, _ := m.index.Get(key)
+	if old == nil && exists || old != nil && (!exists || !bytes.Equal(current, old)) {
+		return false, nil
+	}
+
+	if err := m.append(record{op: opSet, key: key, value: new}); err != nil {
+		return false, err
+	}
+
+	m.index.setUntil(key, new, time.Time{})
+	return true, m.compactIfNeeded()
+}
+
+// Increment adds delta to the integer value of the key. The TTL of the key is
+// kept.
+func (m *FileMemory) Increment(key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists, _ := m.index.Get(key)
+	n, err := addInt(key, current, exists, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	value := []byte(strconv.FormatInt(n, 10))
+	expires := m.index.expiry(key)
+	if err := m.append(record{op: opSet, key: key, value: value, expires: expires}); err != nil {
+		return 0, err
+	}
+
+	m.index.setUntil(key, value, expires)
+	return n, m.compactIfNeeded()
+}
+
+// Transaction keeps the changes of fn in a private copy and writes them as a
+// single record if fn succeeds, so either all or none of them survive a crash.
+func (m *FileMemory) Transaction(fn func(tx MemoryTx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := newBufferedTx(m.index.Get)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.order) == 0 {
+		return nil
+	}
+
+	batch := record{op: opBatch}
+	tx.each(func(key string, value []byte) {
+		nested := record{op: opSet, key: key, value: value}
+		if value == nil {
+			nested.op = opDelete
+		}
+		batch.value = append(batch.value, nested.encode()...)
+	})
+	if err := m.append(batch); err != nil {
+		return err
+	}
+
+	if err := m.apply(batch); err != nil {
+		return err
+	}
+	return m.compactIfNeeded()
+}
+
+// Close closes the file and releases the lock. The data is kept in the file.
+func (m *FileMemory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		return nil
+	}
+
+	err := m.file.Close()
+	m.file = nil
+	_ = m.index.Close()
+	m.lock.unlock()
+	return err
+}
+
+// append writes the record to the end of the log and waits until it is
+// persisted. The caller must hold the lock.
+func (m *FileMemory) append(rec record) error {
+	if m.file == nil {
+		return errors.New("memory file is closed")
+	}
+	if m.failed != nil {
+		return m.failed
+	}
+
+	data := rec.encode()
+	if len(data)-recordHeaderSize > maxRecordSize {
+		return fmt.Errorf("record of %d bytes exceeds the maximum size of %d bytes", len(data)-recordHeaderSize, maxRecordSize)
+	}
+
+	if err := m.write(data); err != nil {
+		m.discardPartialRecord()
+		return err
+	}
+
+	m.size += int64(len(data))
+	m.records++
+	return nil
+}
+
+func (m *FileMemory) write(data []byte) error {
+	if _, err := m.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write memory file: %w", err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync memory file: %w", err)
+	}
+	return nil
+}
+
+// discardPartialRecord removes what a failed write left at the end of the log,
+// so the next record does not follow a broken one. If this fails as well, all
+// further changes are rejected until the log was compacted successfully.
+func (m *FileMemory) discardPartialRecord() {
+	err := m.file.Truncate(m.size)
+	if err == nil {
+		_, err = m.file.Seek(m.size, io.SeekStart)
+	}
+	if err != nil {
+		m.failed = fmt.Errorf("memory file is unusable after a failed write: %w", err)
+	}
+}
+
+// compactIfNeeded compacts the log once most of its records are outdated. The
+// caller must hold the lock.
+func (m *FileMemory) compactIfNeeded() error {
+	if m.records < minCompactRecords || m.records <= 2*m.index.len() {
+		return nil
+	}
+	return m.compact()
+}
+
+// Compact rewrites the file so that it only contains the current data.
+func (m *FileMemory) Compact() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		return errors.New("memory file is closed")
+	}
+	return m.compact()
+}
+
+// compact writes all current data to a temporary file and atomically replaces
+// the log with it. The caller must hold the lock.
+func (m *FileMemory) compact() error {
+	entries := m.index.entries()
+
+	tmpPath := m.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted memory file: %w", err)
+	}
+
+	var size int64
+	w := bufio.NewWriter(tmp)
+	for _, e := range entries {
+		var n int
+		n, err = w.Write(record{op: opSet, key: e.key, value: e.value, expires: e.expires}.encode())
+		size += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write compacted memory file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace memory file: %w", err)
+	}
+	// The temporary file is now the log, so we keep appending to it.
+	m.file.Close()
+	m.file = tmp
+	m.records = len(entries)
+	m.size = size
+	m.failed = nil
+
+	if err := syncDir(filepath.Dir(m.path)); err != nil {
+		return fmt.Errorf("failed to sync directory of memory file: %w", err)
+	}
+	return nil
+}
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// A record is a single change in the log. It is encoded as
+//
+//	length (uint32) | crc32 of payload (uint32) | payload
+//
+// where the payload consists of the operation, the expiry in unix nanoseconds
+// (zero if the key never expires), the length of the key as uvarint, the key
+// and finally the value.
+type record struct {
+	op      byte
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// recordHeaderSize is the size of the length and the checksum of a record.
+const recordHeaderSize = 8
+
+func (r record) encode() []byte {
+	payload := make([]byte, 0, 1+8+binary.MaxVarintLen64+len(r.key)+len(r.value))
+	payload = append(payload, r.op)
+
+	var expires int64
+	if !r.expires.IsZero() {
+		expires = r.expires.UnixNano()
+	}
+	payload = binary.BigEndian.AppendUint64(payload, uint64(expires))
+	payload = binary.AppendUvarint(payload, uint64(len(r.key)))
+	payload = append(payload, r.key...)
+	payload = append(payload, r.value...)
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+// readRecord reads the next record and returns its encoded size. For corrupt
+// records it returns the size according to the header.
+func readRecord(r io.Reader) (record, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return record{}, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	size := int64(len(header)) + int64(length)
+	if length > maxRecordSize {
+		return record{}, size, errCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return record{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) || len(payload) < 9 {
+		return record{}, size, errCorruptRecord
+	}
+
+	rec := record{op: payload[0]}
+	if expires := int64(binary.BigEndian.Uint64(payload[1:9])); expires != 0 {
+		rec.expires = time.Unix(0, expires)
+	}
+
+	keyLen, n := binary.Uvarint(payload[9:])
+	if n <= 0 || uint64(len(payload)-9-n) < keyLen {
+		return record{}, size, errCorruptRecord
+	}
+	start := 9 + n
+	rec.key = string(payload[start : start+int(keyLen)])
+	if rec.op == opSet || rec.op == opBatch {
+		rec.value = payload[start+int(keyLen):]
+	}
+
+	return rec, size, nil
+}
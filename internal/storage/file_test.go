@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestFileMemoryPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+	clk := clock.NewMock()
+
+	memory, err := OpenFileMemory(path, clk)
+	require.NoError(t, err)
+
+	store := NewStorage(zaptest.NewLogger(t))
+	store.SetMemory(memory)
+	require.NoError(t, store.Set("alice", 1))
+	require.NoError(t, store.Set("bob", 2))
+	require.NoError(t, store.SetWithTTL("session", "abc", time.Minute))
+	_, err = store.Increment("alice", 41)
+	require.NoError(t, err)
+	_, err = store.Delete("bob")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	memory, err = OpenFileMemory(path, clk)
+	require.NoError(t, err)
+	defer memory.Close()
+	store.SetMemory(memory)
+
+	n, err := GetAs[int](store, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 42, n)
+
+	_, err = GetAs[int](store, "bob")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	session, err := GetAs[string](store, "session")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", session)
+
+	// the TTL survives a restart
+	clk.Add(time.Minute)
+	_, err = GetAs[string](store, "session")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFileMemoryCompareAndSwap(t *testing.T) {
+	memory, err := OpenFileMemory(filepath.Join(t.TempDir(), "botty.db"), clock.New())
+	require.NoError(t, err)
+	defer memory.Close()
+
+	swapped, err := memory.CompareAndSwap("key", nil, []byte("a"))
+	require.NoError(t, err)
+	assert.True(t, swapped)
+
+	swapped, err = memory.CompareAndSwap("key", nil, []byte("b"))
+	require.NoError(t, err)
+	assert.False(t, swapped)
+
+	swapped, err = memory.CompareAndSwap("key", []byte("a"), []byte("b"))
+	require.NoError(t, err)
+	assert.True(t, swapped)
+
+	value, _, err := memory.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b"), value)
+}
+
+func TestFileMemoryDiscardsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+
+	memory, err := OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	require.NoError(t, memory.Set("a", []byte("1")))
+	require.NoError(t, memory.Set("b", []byte("2")))
+	require.NoError(t, memory.Close())
+
+	// simulate a crash in the middle of the last write
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-1))
+
+	memory, err = OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+
+	keys, _, err := memory.Scan("", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, keys)
+
+	// new records are appended after the last complete one
+	require.NoError(t, memory.Set("c", []byte("3")))
+	require.NoError(t, memory.Close())
+
+	memory, err = OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	defer memory.Close()
+
+	keys, _, err = memory.Scan("", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, keys)
+}
+
+func TestFileMemoryRejectsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+
+	memory, err := OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, memory.Set(key, []byte("1")))
+	}
+	require.NoError(t, memory.Close())
+
+	original, err := os.ReadFile(path)
+	require.NoError(t, err)
+	recordSize := len(record{op: opSet, key: "a", value: []byte("1")}.encode())
+	require.Len(t, original, 3*recordSize)
+
+	// a corrupt record in the middle of the log is no torn write
+	corrupt := append([]byte{}, original...)
+	corrupt[recordSize+recordHeaderSize+1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, corrupt, 0o600))
+
+	_, err = OpenFileMemory(path, clock.New())
+	assert.ErrorIs(t, err, errCorruptRecord)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, corrupt, data)
+
+	// a corrupt last record is discarded
+	corrupt = append([]byte{}, original...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, corrupt, 0o600))
+
+	memory, err = OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	defer memory.Close()
+
+	keys, _, err := memory.Scan("", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+}
+
+func TestFileMemoryRecoversFromFailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+
+	memory, err := OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	require.NoError(t, memory.Set("a", []byte("1")))
+
+	// simulate a write that failed after writing part of the record
+	_, err = memory.file.Write(record{op: opSet, key: "b", value: []byte("2")}.encode()[:5])
+	require.NoError(t, err)
+	memory.discardPartialRecord()
+	require.NoError(t, memory.failed)
+
+	require.NoError(t, memory.Set("c", []byte("3")))
+	require.NoError(t, memory.Close())
+
+	memory, err = OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	defer memory.Close()
+
+	keys, _, err := memory.Scan("", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, keys)
+}
+
+func TestFileMemoryFailsAfterUnrecoverableWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+
+	memory, err := OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	defer memory.Close()
+	require.NoError(t, memory.Set("a", []byte("1")))
+
+	// neither writing nor truncating works with a closed file
+	require.NoError(t, memory.file.Close())
+	assert.Error(t, memory.Set("b", []byte("2")))
+	assert.ErrorContains(t, memory.Set("c", []byte("3")), "unusable")
+
+	// compacting writes a new file, so the memory can be used again
+	require.NoError(t, memory.Compact())
+	require.NoError(t, memory.Set("c", []byte("3")))
+
+	keys, _, err := memory.Scan("", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, keys)
+}
+
+func TestFileMemoryRecordSizeLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+
+	memory, err := OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	require.NoError(t, memory.Set("a", []byte("1")))
+	assert.Error(t, memory.Set("big", make([]byte, maxRecordSize)))
+	require.NoError(t, memory.Close())
+
+	// a corrupt length must not be allocated
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	memory, err = OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	defer memory.Close()
+
+	keys, _, err := memory.Scan("", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, keys)
+}
+
+func TestFileMemoryCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+
+	memory, err := OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := memory.Increment("counter", 1)
+		require.NoError(t, err)
+	}
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	require.NoError(t, memory.Compact())
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size())
+
+	// the compacted file is still used for appending
+	_, err = memory.Increment("counter", 1)
+	require.NoError(t, err)
+	require.NoError(t, memory.Close())
+
+	memory, err = OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	defer memory.Close()
+
+	value, _, err := memory.Get("counter")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("101"), value)
+	assert.NoFileExists(t, path+".tmp")
+}
+
+func TestFileMemoryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botty.db")
+
+	memory, err := OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+
+	_, err = OpenFileMemory(path, clock.New())
+	assert.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, memory.Close())
+	memory, err = OpenFileMemory(path, clock.New())
+	require.NoError(t, err)
+	require.NoError(t, memory.Close())
+}
@@ -0,0 +1,39 @@
+//go:build !unix
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// A fileLock is an exclusive lock on a file. Without flock the lock file is
+// created exclusively and removed again on unlock, so a crashed process leaves
+// a stale lock file behind that must be removed by hand.
+type fileLock struct {
+	path string
+}
+
+func lockFile(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("%s: %w", path, ErrLocked)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock file: %w", err)
+	}
+
+	f.Close()
+	return &fileLock{path: path}, nil
+}
+
+func (l *fileLock) unlock() {
+	_ = os.Remove(l.path)
+}
+
+// syncDir does nothing because directories cannot be synced on all platforms.
+// The rename itself is still atomic.
+func syncDir(string) error {
+	return nil
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// janitorInterval is the time between two runs of the janitor that deletes
+// expired keys of the InMemory.
+const janitorInterval = time.Minute
+
+// InMemory is a Memory that keeps all data in a map. It implements the
+// AtomicMemory, the ExpiringMemory and the TransactionalMemory interface.
+// Expired keys are never returned and they are deleted by a background janitor
+// which is started with the first key that has a TTL.
+type InMemory struct {
+	mu      sync.Mutex
+	clock   clock.Clock
+	data    map[string][]byte
+	expires map[string]time.Time // only contains keys with a TTL
+	janitor chan struct{}        // closed to stop the janitor, nil if it is not running
+}
+
+// NewInMemory creates an empty InMemory that uses the clock to expire keys.
+// Tests can pass a *clock.Mock to control the expiry.
+func NewInMemory(clk clock.Clock) *InMemory {
+	return &InMemory{
+		clock:   clk,
+		data:    map[string][]byte{},
+		expires: map[string]time.Time{},
+	}
+}
+
+// Close deletes all data and stops the janitor.
+func (m *InMemory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.janitor != nil {
+		close(m.janitor)
+		m.janitor = nil
+	}
+	m.data = map[string][]byte{}
+	m.expires = map[string]time.Time{}
+	return nil
+}
+
+func (m *InMemory) Delete(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ok := m.exists(key)
+	m.delete(key)
+	return ok, nil
+}
+
+func (m *InMemory) Set(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = value
+	delete(m.expires, key)
+	return nil
+}
+
+// SetWithTTL stores the value until the TTL has passed.
+func (m *InMemory) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	m.setUntil(key, value, m.clock.Now().Add(ttl))
+	return nil
+}
+
+// setUntil stores the value until the given time. The zero time means that the
+// key never expires.
+func (m *InMemory) setUntil(key string, value []byte, expires time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = value
+	if expires.IsZero() {
+		delete(m.expires, key)
+		return
+	}
+
+	m.expires[key] = expires
+	m.startJanitor()
+}
+
+// expiry returns when the key expires or the zero time if it has no TTL.
+func (m *InMemory) expiry(key string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expires[key]
+}
+
+// len returns the number of keys including expired keys that the janitor did
+// not delete yet.
+func (m *InMemory) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.data)
+}
+
+// A memoryEntry is a single key-value pair together with its expiry.
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time // zero if the key never expires
+}
+
+// entries returns all keys that are not expired in lexicographical order.
+func (m *InMemory) entries() []memoryEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]memoryEntry, 0, len(m.data))
+	for k, v := range m.data {
+		if m.exists(k) {
+			entries = append(entries, memoryEntry{key: k, value: v, expires: m.expires[k]})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries
+}
+
+func (m *InMemory) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.exists(key) {
+		return nil, false, nil
+	}
+	return m.data[key], true, nil
+}
+
+// CompareAndSwap sets the key to new if its current value is old. A nil old
+// value means that the key must not exist. The TTL of the key is removed.
+func (m *InMemory) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	exists := m.exists(key)
+	if old == nil && exists || old != nil && (!exists || !bytes.Equal(m.data[key], old)) {
+		return false, nil
+	}
+
+	m.data[key] = new
+	delete(m.expires, key)
+	return true, nil
+}
+
+// Increment adds delta to the integer value of the key. The TTL of the key is
+// kept.
+func (m *InMemory) Increment(key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := addInt(key, m.data[key], m.exists(key), delta)
+	if err != nil {
+		return 0, err
+	}
+
+	m.data[key] = []byte(strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+// Transaction keeps the changes of fn in a private copy and applies them at
+// once if fn succeeds. The InMemory is locked while fn is running.
+func (m *InMemory) Transaction(fn func(tx MemoryTx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := newBufferedTx(func(key string) ([]byte, bool, error) {
+		if !m.exists(key) {
+			return nil, false, nil
+		}
+		return m.data[key], true, nil
+	})
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	tx.each(func(key string, value []byte) {
+		if value == nil {
+			m.delete(key)
+			return
+		}
+		m.data[key] = value
+		delete(m.expires, key)
+	})
+	return nil
+}
+
+func (m *InMemory) Keys() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		if m.exists(k) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, nil
+}
+
+// Scan returns the keys in lexicographical order. The cursor is the last key
+// that was returned.
+func (m *InMemory) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for k := range m.data {
+		if strings.HasPrefix(k, prefix) && k > cursor && m.exists(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	if limit <= 0 || len(keys) <= limit {
+		return keys, "", nil
+	}
+
+	keys = keys[:limit]
+	return keys, keys[limit-1], nil
+}
+
+// exists reports whether the key is stored and not expired. Expired keys are
+// deleted lazily. The caller must hold the lock.
+func (m *InMemory) exists(key string) bool {
+	if _, ok := m.data[key]; !ok {
+		return false
+	}
+
+	if expires, ok := m.expires[key]; ok && !m.clock.Now().Before(expires) {
+		m.delete(key)
+		return false
+	}
+	return true
+}
+
+func (m *InMemory) delete(key string) {
+	delete(m.data, key)
+	delete(m.expires, key)
+}
+
+// deleteExpired deletes all keys whose TTL has passed.
+func (m *InMemory) deleteExpired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.expires {
+		m.exists(key)
+	}
+}
+
+// startJanitor starts the janitor unless it is running already. The caller
+// must hold the lock.
+func (m *InMemory) startJanitor() {
+	if m.janitor != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	m.janitor = stop
+
+	// The ticker is created before the goroutine starts, so a *clock.Mock
+	// already knows about it when the caller returns.
+	ticker := m.clock.Ticker(janitorInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.deleteExpired()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type msgPackEncoder struct{}
+
+// NewMsgPackEncoder returns a MemoryEncoder that stores values as
+// MessagePack using github.com/vmihailenco/msgpack. Structs are stored as maps
+// of their exported fields. The keys can be changed with msgpack struct tags
+// like `msgpack:"name,omitempty"` and fields without msgpack tag use their
+// json tag. Byte slices and arrays are stored as binary and time.Time values
+// as timestamp extension. The keys of map[string]interface{},
+// map[string]string and map[string]bool values are sorted, so equal values
+// of these types are always encoded the same way.
+//
+// When decoding into an interface, integers become int64 or uint64 depending
+// on their format, floats become float64 and binary data becomes a string.
+func NewMsgPackEncoder() MemoryEncoder {
+	return new(msgPackEncoder)
+}
+
+func (msgPackEncoder) Encode(value interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	enc.SetSortMapKeys(true)
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgPackEncoder) Decode(data []byte, target interface{}) error {
+	r := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	dec.UseLooseInterfaceDecoding(true)
+
+	if err := dec.Decode(target); err != nil {
+		return fmt.Errorf("invalid msgpack: %w", err)
+	}
+	if r.Len() > 0 {
+		return errors.New("invalid msgpack: trailing data")
+	}
+	return nil
+}
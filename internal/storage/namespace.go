@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// Namespace returns a Storage that prefixes all keys with the name and a
+// colon, so plugins can keep their keys apart while sharing the same Memory.
+// The keys that are returned by Keys and Scan do not include the prefix.
+// The namespace always uses the current Memory of s, even if it is replaced
+// via SetMemory later, but the MemoryEncoder and the Observer are the ones of
+// s at the time of the call. Closing the returned Storage does not close the
+// shared Memory.
+func (s *Storage) Namespace(name string) *Storage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &Storage{
+		logger:   s.logger,
+		memory:   &namespacedMemory{parent: s, prefix: name + ":"},
+		encoder:  s.encoder,
+		observer: s.observer,
+	}
+}
+
+// as returns the Memory as optional interface T, e.g. as AtomicMemory. Memory
+// wrappers implement all optional interfaces, so they are only treated as T
+// if the Memory they wrap implements T as well.
+func as[T any](m Memory) (T, bool) {
+	if w, ok := m.(interface{ Unwrap() Memory }); ok {
+		if _, ok := as[T](w.Unwrap()); !ok {
+			var zero T
+			return zero, false
+		}
+	}
+
+	t, ok := m.(T)
+	return t, ok
+}
+
+// The namespacedMemory prefixes all keys of the Memory of its parent Storage.
+type namespacedMemory struct {
+	parent *Storage
+	prefix string
+}
+
+// Unwrap returns the current Memory of the parent, which is shared by all
+// namespaces.
+func (m *namespacedMemory) Unwrap() Memory {
+	m.parent.mu.RLock()
+	defer m.parent.mu.RUnlock()
+	return m.parent.memory
+}
+
+func (m *namespacedMemory) Set(key string, value []byte) error {
+	return m.Unwrap().Set(m.prefix+key, value)
+}
+
+func (m *namespacedMemory) Get(key string) ([]byte, bool, error) {
+	return m.Unwrap().Get(m.prefix + key)
+}
+
+func (m *namespacedMemory) Delete(key string) (bool, error) {
+	return m.Unwrap().Delete(m.prefix + key)
+}
+
+func (m *namespacedMemory) Keys() ([]string, error) {
+	all, err := m.Unwrap().Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, key := range all {
+		if strings.HasPrefix(key, m.prefix) {
+			keys = append(keys, strings.TrimPrefix(key, m.prefix))
+		}
+	}
+	return keys, nil
+}
+
+func (m *namespacedMemory) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	keys, next, err := m.Unwrap().Scan(m.prefix+prefix, cursor, limit)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, m.prefix)
+	}
+	return keys, next, err
+}
+
+// Close does nothing because the Memory is shared with other namespaces.
+func (m *namespacedMemory) Close() error {
+	return nil
+}
+
+func (m *namespacedMemory) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return m.Unwrap().(ExpiringMemory).SetWithTTL(m.prefix+key, value, ttl)
+}
+
+func (m *namespacedMemory) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	return m.Unwrap().(AtomicMemory).CompareAndSwap(m.prefix+key, old, new)
+}
+
+func (m *namespacedMemory) Increment(key string, delta int64) (int64, error) {
+	return m.Unwrap().(AtomicMemory).Increment(m.prefix+key, delta)
+}
+
+func (m *namespacedMemory) Transaction(fn func(tx MemoryTx) error) error {
+	return m.Unwrap().(TransactionalMemory).Transaction(func(tx MemoryTx) error {
+		return fn(&namespacedTx{tx: tx, prefix: m.prefix})
+	})
+}
+
+func (m *namespacedMemory) Ping() error {
+	return m.Unwrap().(Pinger).Ping()
+}
+
+// The namespacedTx prefixes all keys of a transaction of the shared Memory.
+type namespacedTx struct {
+	tx     MemoryTx
+	prefix string
+}
+
+func (tx *namespacedTx) Set(key string, value []byte) error {
+	return tx.tx.Set(tx.prefix+key, value)
+}
+
+func (tx *namespacedTx) Get(key string) ([]byte, bool, error) {
+	return tx.tx.Get(tx.prefix + key)
+}
+
+func (tx *namespacedTx) Delete(key string) (bool, error) {
+	return tx.tx.Delete(tx.prefix + key)
+}
@@ -1,6 +1,12 @@
 package storage
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-redis/redis"
 	"go.uber.org/zap"
 )
@@ -18,6 +24,9 @@ type RedisMemory struct {
 	logger *zap.Logger
 	Client *redis.Client
 	hkey   string
+
+	mu          sync.Mutex
+	fieldExpiry *bool // whether the server supports HPEXPIRE, nil until checked
 }
 
 func NewRedisStorage(config Config) Memory {
@@ -43,18 +52,147 @@ func (rm *RedisMemory) Set(key string, value []byte) error {
 	return resp.Err()
 }
 
+// SetWithTTL stores the value and lets Redis expire the hash field via
+// HPEXPIRE. It returns ErrExpiryNotSupported if the server is older than
+// Redis 7.4, which introduced expiring hash fields.
+func (rm *RedisMemory) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	ok, err := rm.supportsFieldExpiry()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrExpiryNotSupported
+	}
+
+	_, err = rm.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(rm.hkey, key, value)
+		pipe.Do("HPEXPIRE", rm.hkey, ttl.Milliseconds(), "FIELDS", 1, key)
+		return nil
+	})
+	return err
+}
+
+// supportsFieldExpiry reports whether the server is Redis 7.4 or newer. The
+// version is only requested once.
+func (rm *RedisMemory) supportsFieldExpiry() (bool, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.fieldExpiry == nil {
+		info, err := rm.Client.Info("server").Result()
+		if err != nil {
+			return false, fmt.Errorf("failed to determine the redis version: %w", err)
+		}
+
+		major, minor := redisVersion(info)
+		ok := major > 7 || major == 7 && minor >= 4
+		rm.fieldExpiry = &ok
+	}
+
+	return *rm.fieldExpiry, nil
+}
+
+// redisVersion returns the major and minor version from the output of the
+// INFO command or zero if the version is missing.
+func redisVersion(info string) (major, minor int) {
+	for _, line := range strings.Split(info, "\n") {
+		version, ok := strings.CutPrefix(strings.TrimSpace(line), "redis_version:")
+		if !ok {
+			continue
+		}
+
+		parts := strings.SplitN(version, ".", 3)
+		major, _ = strconv.Atoi(parts[0])
+		if len(parts) > 1 {
+			minor, _ = strconv.Atoi(parts[1])
+		}
+		return major, minor
+	}
+	return 0, 0
+}
+
+// compareAndSwapScript sets the hash field ARGV[1] to ARGV[4] if its value is
+// ARGV[3]. If ARGV[2] is "0", the field must not exist instead.
+var compareAndSwapScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], ARGV[1])
+if ARGV[2] == "0" then
+	if current then return 0 end
+elseif current ~= ARGV[3] then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[4])
+return 1
+`)
+
+// CompareAndSwap atomically sets the key to new if its value is old, using a
+// Lua script so that it is safe when several bots share the same hash.
+func (rm *RedisMemory) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	exists := "1"
+	if old == nil {
+		exists = "0"
+	}
+
+	n, err := compareAndSwapScript.Run(rm.Client, []string{rm.hkey}, key, exists, old, new).Int()
+	return n == 1, err
+}
+
+// Increment atomically adds delta to the value of the key via HINCRBY.
+func (rm *RedisMemory) Increment(key string, delta int64) (int64, error) {
+	return rm.Client.HIncrBy(rm.hkey, key, delta).Result()
+}
+
 func (rm *RedisMemory) Get(key string) ([]byte, bool, error) {
-	resp, err := rm.Client.HGet(rm.hkey, key).Result()
+	return hgetResult(rm.Client.HGet(rm.hkey, key))
+}
+
+// hgetResult returns the result of a HGET command like Memory.Get.
+func hgetResult(cmd *redis.StringCmd) ([]byte, bool, error) {
+	resp, err := cmd.Result()
 	switch {
-	case err != nil:
-		return nil, false, err
 	case err == redis.Nil:
 		return nil, false, nil
+	case err != nil:
+		return nil, false, err
 	default:
 		return []byte(resp), true, nil
 	}
 }
 
+// Transaction watches the hash and applies the changes of fn with MULTI/EXEC.
+// If another client changes the hash before EXEC, fn is called again.
+func (rm *RedisMemory) Transaction(fn func(tx MemoryTx) error) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		err := rm.Client.Watch(func(rtx *redis.Tx) error {
+			tx := newBufferedTx(func(key string) ([]byte, bool, error) {
+				return hgetResult(rtx.HGet(rm.hkey, key))
+			})
+			if err := fn(tx); err != nil {
+				return err
+			}
+			if len(tx.order) == 0 {
+				return nil
+			}
+
+			_, err := rtx.TxPipelined(func(pipe redis.Pipeliner) error {
+				tx.each(func(key string, value []byte) {
+					if value == nil {
+						pipe.HDel(rm.hkey, key)
+					} else {
+						pipe.HSet(rm.hkey, key, value)
+					}
+				})
+				return nil
+			})
+			return err
+		}, rm.hkey)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to commit transaction after %d attempts: %w", maxUpdateAttempts, ErrConflict)
+}
+
 func (rm *RedisMemory) Delete(key string) (bool, error) {
 	resp, err := rm.Client.HDel(rm.hkey, key).Result()
 	return resp > 0, err
@@ -64,6 +202,43 @@ func (b *RedisMemory) Keys() ([]string, error) {
 	return b.Client.HKeys(b.hkey).Result()
 }
 
+// Ping sends a PING to the Redis server.
+func (rm *RedisMemory) Ping() error {
+	return rm.Client.Ping().Err()
+}
+
+// Scan iterates over the hash via HSCAN. The limit is passed as COUNT, which
+// Redis only treats as a hint.
+func (rm *RedisMemory) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	var start uint64
+	if cursor != "" {
+		var err error
+		start, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q: %w", cursor, err)
+		}
+	}
+
+	pairs, next, err := rm.Client.HScan(rm.hkey, start, globEscaper.Replace(prefix)+"*", int64(limit)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// HSCAN returns the fields together with their values.
+	keys := make([]string, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		keys = append(keys, pairs[i])
+	}
+
+	if next == 0 {
+		return keys, "", nil
+	}
+	return keys, strconv.FormatUint(next, 10), nil
+}
+
+// globEscaper escapes all special characters of the MATCH pattern of HSCAN.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
 func (b *RedisMemory) Close() error {
 	return b.Client.Close()
 }
@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/benbjohnson/clock"
+)
+
+// A SQLDialect selects the SQL syntax of the database.
+type SQLDialect int
+
+const (
+	// SQLite is the dialect of SQLite 3.24 or newer.
+	SQLite SQLDialect = iota
+	// Postgres is the dialect of PostgreSQL 9.5 or newer.
+	Postgres
+)
+
+// SQLConfig contains all settings for the SQL memory.
+type SQLConfig struct {
+	// Driver is the name of the database/sql driver, which must be registered
+	// by importing it, e.g. "sqlite" or "postgres".
+	Driver  string
+	DSN     string
+	Dialect SQLDialect
+	// Clock is used to expire keys. It defaults to the wall clock.
+	Clock clock.Clock
+}
+
+// sqlMigrations are the changes to the schema in the order in which they are
+// applied. The version of a migration is its index plus one. Migrations must
+// never be changed once they are released, add a new one instead.
+var sqlMigrations = []func(d SQLDialect) string{
+	func(d SQLDialect) string {
+		blob := "BLOB"
+		if d == Postgres {
+			blob = "BYTEA"
+		}
+		return "CREATE TABLE botty_memory (key TEXT PRIMARY KEY, value " + blob + " NOT NULL)"
+	},
+	func(SQLDialect) string {
+		// Unix nanoseconds after which the key is expired, NULL if it never
+		// expires.
+		return "ALTER TABLE botty_memory ADD COLUMN expires_at BIGINT"
+	},
+	func(SQLDialect) string {
+		return "CREATE INDEX botty_memory_expires_at ON botty_memory (expires_at)"
+	},
+}
+
+// The statements of the SQL memory. Placeholders are written as ? and
+// rewritten for the dialect by SQLMemory.query.
+const (
+	sqlCreateMigrations = "CREATE TABLE IF NOT EXISTS botty_schema_migrations (version INTEGER PRIMARY KEY)"
+	sqlSchemaVersion    = "SELECT COALESCE(MAX(version), 0) FROM botty_schema_migrations"
+	sqlInsertVersion    = "INSERT INTO botty_schema_migrations (version) VALUES (?)"
+
+	// sqlLockMigrations makes the transaction a writer before it reads the
+	// schema version. SQLite allows only one writer at a time, so this locks
+	// the database without changing anything.
+	sqlLockMigrations         = "DELETE FROM botty_schema_migrations WHERE version < 0"
+	sqlLockMigrationsPostgres = "LOCK TABLE botty_schema_migrations IN EXCLUSIVE MODE"
+
+	sqlNotExpired = "(expires_at IS NULL OR expires_at > ?)"
+
+	sqlSet = "INSERT INTO botty_memory (key, value, expires_at) VALUES (?, ?, ?) " +
+		"ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at"
+	sqlGet           = "SELECT value FROM botty_memory WHERE key = ? AND " + sqlNotExpired
+	sqlDelete        = "DELETE FROM botty_memory WHERE key = ? AND " + sqlNotExpired
+	sqlDeleteExpired = "DELETE FROM botty_memory WHERE expires_at <= ?"
+	sqlKeys          = "SELECT key FROM botty_memory WHERE " + sqlNotExpired
+	sqlScan          = "SELECT key FROM botty_memory WHERE substr(key, 1, ?) = ? AND key > ? AND " + sqlNotExpired + " ORDER BY key"
+	sqlScanLimit     = sqlScan + " LIMIT ?"
+
+	// sqlInsertIfAbsent inserts the key unless it exists and is not expired.
+	sqlInsertIfAbsent = "INSERT INTO botty_memory (key, value, expires_at) VALUES (?, ?, NULL) " +
+		"ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = NULL " +
+		"WHERE botty_memory.expires_at IS NOT NULL AND botty_memory.expires_at <= ?"
+	// sqlSwap replaces the value and removes the TTL of the key.
+	sqlSwap = "UPDATE botty_memory SET value = ?, expires_at = NULL WHERE key = ? AND value = ? AND " + sqlNotExpired
+	// sqlReplace replaces the value and keeps the TTL of the key.
+	sqlReplace = "UPDATE botty_memory SET value = ? WHERE key = ? AND value = ? AND " + sqlNotExpired
+)
+
+// SQLMemory is a Memory that stores all data in a single table of a SQL
+// database. The schema is migrated when the memory is created. It implements
+// the AtomicMemory, the ExpiringMemory and the TransactionalMemory interface.
+// Expired rows are never returned and they are deleted on startup or when the
+// key is set again.
+type SQLMemory struct {
+	db      *sql.DB
+	dialect SQLDialect
+	clock   clock.Clock
+}
+
+// NewSQLMemory connects to the database and migrates the schema to the latest
+// version.
+func NewSQLMemory(config SQLConfig) (*SQLMemory, error) {
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	m := &SQLMemory{db: db, dialect: config.Dialect, clock: config.Clock}
+	if m.clock == nil {
+		m.clock = clock.New()
+	}
+
+	if err := m.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := m.exec(sqlDeleteExpired, m.now()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to delete expired keys: %w", err)
+	}
+
+	return m, nil
+}
+
+// SchemaVersion returns the version of the schema of the database.
+func (m *SQLMemory) SchemaVersion() (int, error) {
+	var version int
+	err := m.db.QueryRow(m.query(sqlSchemaVersion)).Scan(&version)
+	return version, err
+}
+
+// migrate applies all migrations that are newer than the version of the
+// schema. Each migration runs in its own transaction.
+func (m *SQLMemory) migrate(ctx context.Context) error {
+	if _, err := m.db.ExecContext(ctx, sqlCreateMigrations); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	for {
+		done, err := m.migrateStep(ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateStep applies the migration after the current version of the schema
+// and reports whether the schema was up to date already.
+func (m *SQLMemory) migrateStep(ctx context.Context) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	done, err := m.migrateNext(ctx, tx)
+	if err != nil || done {
+		_ = tx.Rollback()
+		return done, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit schema migration: %w", err)
+	}
+	return false, nil
+}
+
+// migrateNext locks the migrations table before it reads the version of the
+// schema, so bots that start at the same time wait for each other instead of
+// applying the same migration twice.
+func (m *SQLMemory) migrateNext(ctx context.Context, tx *sql.Tx) (bool, error) {
+	if _, err := tx.ExecContext(ctx, m.migrationsLock()); err != nil {
+		return false, fmt.Errorf("failed to lock migrations table: %w", err)
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, sqlSchemaVersion).Scan(&version); err != nil {
+		return false, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	switch {
+	case version == len(sqlMigrations):
+		return true, nil
+	case version > len(sqlMigrations):
+		return false, fmt.Errorf("schema version %d is newer than the supported version %d", version, len(sqlMigrations))
+	}
+
+	_, err := tx.ExecContext(ctx, sqlMigrations[version](m.dialect))
+	if err == nil {
+		_, err = tx.ExecContext(ctx, m.query(sqlInsertVersion), version+1)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to migrate schema to version %d: %w", version+1, err)
+	}
+	return false, nil
+}
+
+func (m *SQLMemory) Set(key string, value []byte) error {
+	_, err := m.exec(sqlSet, key, sqlValue(value), nil)
+	return err
+}
+
+// SetWithTTL stores the value until the TTL has passed.
+func (m *SQLMemory) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	_, err := m.exec(sqlSet, key, sqlValue(value), m.clock.Now().Add(ttl).UnixNano())
+	return err
+}
+
+func (m *SQLMemory) Get(key string) ([]byte, bool, error) {
+	return scanValue(m.db.QueryRow(m.query(sqlGet), key, m.now()))
+}
+
+// scanValue returns the result of the sqlGet query like Memory.Get.
+func scanValue(row *sql.Row) ([]byte, bool, error) {
+	var value []byte
+	err := row.Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (m *SQLMemory) Delete(key string) (bool, error) {
+	return m.exec(sqlDelete, key, m.now())
+}
+
+func (m *SQLMemory) Keys() ([]string, error) {
+	return m.queryKeys(sqlKeys, m.now())
+}
+
+// Scan returns the keys in the order of the database collation. The cursor is
+// the last key that was returned.
+func (m *SQLMemory) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	args := []interface{}{utf8.RuneCountInString(prefix), prefix, cursor, m.now()}
+	if limit <= 0 {
+		keys, err := m.queryKeys(sqlScan, args...)
+		return keys, "", err
+	}
+
+	// Fetch one more key to find out whether there is another page.
+	keys, err := m.queryKeys(sqlScanLimit, append(args, limit+1)...)
+	if err != nil || len(keys) <= limit {
+		return keys, "", err
+	}
+
+	keys = keys[:limit]
+	return keys, keys[limit-1], nil
+}
+
+// CompareAndSwap sets the key to new if its current value is old. A nil old
+// value means that the key must not exist. The TTL of the key is removed.
+func (m *SQLMemory) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	if old == nil {
+		return m.exec(sqlInsertIfAbsent, key, sqlValue(new), m.now())
+	}
+	return m.exec(sqlSwap, sqlValue(new), key, old, m.now())
+}
+
+// Increment adds delta to the integer value of the key. The TTL of the key is
+// kept.
+func (m *SQLMemory) Increment(key string, delta int64) (int64, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		old, exists, err := m.Get(key)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := addInt(key, old, exists, delta)
+		if err != nil {
+			return 0, err
+		}
+
+		value := []byte(strconv.FormatInt(n, 10))
+		var ok bool
+		if exists {
+			ok, err = m.exec(sqlReplace, value, key, old, m.now())
+		} else {
+			ok, err = m.exec(sqlInsertIfAbsent, key, value, m.now())
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return n, nil
+		}
+	}
+
+	return 0, fmt.Errorf("failed to increment %q after %d attempts: %w", key, maxUpdateAttempts, ErrConflict)
+}
+
+// Transaction runs fn in a database transaction which is committed if fn
+// succeeds.
+func (m *SQLMemory) Transaction(fn func(tx MemoryTx) error) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&sqlTx{memory: m, tx: tx}); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Ping checks whether the database responds.
+func (m *SQLMemory) Ping() error {
+	return m.db.Ping()
+}
+
+// Close closes the connections to the database.
+func (m *SQLMemory) Close() error {
+	return m.db.Close()
+}
+
+// exec executes the statement and reports whether it changed any rows.
+func (m *SQLMemory) exec(query string, args ...interface{}) (bool, error) {
+	return changed(m.db.Exec(m.query(query), args...))
+}
+
+// changed reports whether the statement changed any rows.
+func changed(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (m *SQLMemory) queryKeys(query string, args ...interface{}) ([]string, error) {
+	rows, err := m.db.Query(m.query(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// migrationsLock returns the statement that locks the migrations table for the
+// dialect.
+func (m *SQLMemory) migrationsLock() string {
+	if m.dialect == Postgres {
+		return sqlLockMigrationsPostgres
+	}
+	return sqlLockMigrations
+}
+
+// query rewrites the placeholders of the statement for the dialect.
+func (m *SQLMemory) query(query string) string {
+	if m.dialect != Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (m *SQLMemory) now() int64 {
+	return m.clock.Now().UnixNano()
+}
+
+// sqlValue returns the value that is stored in the value column. The column
+// does not allow NULL, so a nil value is stored as empty value.
+func sqlValue(value []byte) []byte {
+	if value == nil {
+		return []byte{}
+	}
+	return value
+}
+
+// A sqlTx is a transaction of the SQLMemory.
+type sqlTx struct {
+	memory *SQLMemory
+	tx     *sql.Tx
+}
+
+func (tx *sqlTx) Set(key string, value []byte) error {
+	_, err := tx.tx.Exec(tx.memory.query(sqlSet), key, sqlValue(value), nil)
+	return err
+}
+
+func (tx *sqlTx) Get(key string) ([]byte, bool, error) {
+	return scanValue(tx.tx.QueryRow(tx.memory.query(sqlGet), key, tx.memory.now()))
+}
+
+func (tx *sqlTx) Delete(key string) (bool, error) {
+	return changed(tx.tx.Exec(tx.memory.query(sqlDelete), key, tx.memory.now()))
+}
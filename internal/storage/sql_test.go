@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	_ "modernc.org/sqlite"
+)
+
+var sqliteDatabases int64
+
+// sqliteDSN returns the DSN of a new in-memory SQLite database. The database
+// is shared by all connections of the pool and deleted once they are closed.
+func sqliteDSN() string {
+	return fmt.Sprintf("file:/botty-%d?vfs=memdb", atomic.AddInt64(&sqliteDatabases, 1))
+}
+
+func newSQLiteMemory(t *testing.T, clk clock.Clock) *SQLMemory {
+	memory, err := NewSQLMemory(SQLConfig{Driver: "sqlite", DSN: sqliteDSN(), Clock: clk})
+	require.NoError(t, err)
+	t.Cleanup(func() { memory.Close() })
+	return memory
+}
+
+func TestSQLMemoryMigrations(t *testing.T) {
+	dsn := sqliteDSN()
+	memory, err := NewSQLMemory(SQLConfig{Driver: "sqlite", DSN: dsn})
+	require.NoError(t, err)
+	defer memory.Close()
+
+	version, err := memory.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, len(sqlMigrations), version)
+
+	// migrations are only applied once
+	again, err := NewSQLMemory(SQLConfig{Driver: "sqlite", DSN: dsn})
+	require.NoError(t, err)
+	defer again.Close()
+
+	var versions []int
+	rows, err := memory.db.Query("SELECT version FROM botty_schema_migrations ORDER BY version")
+	require.NoError(t, err)
+	for rows.Next() {
+		var v int
+		require.NoError(t, rows.Scan(&v))
+		versions = append(versions, v)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []int{1, 2, 3}, versions)
+
+	// a schema from the future is rejected
+	_, err = memory.db.Exec("INSERT INTO botty_schema_migrations (version) VALUES (99)")
+	require.NoError(t, err)
+	_, err = NewSQLMemory(SQLConfig{Driver: "sqlite", DSN: dsn})
+	assert.ErrorContains(t, err, "newer")
+}
+
+func TestSQLMemoryConcurrentMigrations(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "botty.db") + "?_pragma=busy_timeout(10000)"
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			memory, err := NewSQLMemory(SQLConfig{Driver: "sqlite", DSN: dsn})
+			if err == nil {
+				err = memory.Close()
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	memory, err := NewSQLMemory(SQLConfig{Driver: "sqlite", DSN: dsn})
+	require.NoError(t, err)
+	defer memory.Close()
+
+	version, err := memory.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, len(sqlMigrations), version)
+}
+
+func TestSQLMemory(t *testing.T) {
+	clk := clock.NewMock()
+	store := NewStorage(zaptest.NewLogger(t))
+	store.SetMemory(newSQLiteMemory(t, clk))
+
+	require.NoError(t, store.Set("karma:alice", 1))
+	require.NoError(t, store.Set("karma:bob", 2))
+	require.NoError(t, store.SetWithTTL("karma:carol", 3, time.Minute))
+	require.NoError(t, store.Set("quotes:alice", "hello"))
+
+	n, err := store.Increment("karma:carol", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+
+	keys, next, err := store.Scan("karma:", "", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"karma:alice", "karma:bob"}, keys)
+	keys, next, err = store.Scan("karma:", next, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"karma:carol"}, keys)
+	assert.Empty(t, next)
+
+	// the increment kept the TTL
+	clk.Add(time.Minute)
+	_, err = GetAs[int](store, "karma:carol")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	keys, err = store.Keys()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"karma:alice", "karma:bob", "quotes:alice"}, keys)
+
+	ok, err := store.Delete("karma:bob")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	err = store.Update("karma:alice", new(int), func(bool) error { return nil })
+	require.NoError(t, err)
+}
+
+func TestSQLMemoryCompareAndSwap(t *testing.T) {
+	clk := clock.NewMock()
+	memory := newSQLiteMemory(t, clk)
+
+	swapped, err := memory.CompareAndSwap("key", nil, []byte("a"))
+	require.NoError(t, err)
+	assert.True(t, swapped)
+
+	swapped, err = memory.CompareAndSwap("key", nil, []byte("b"))
+	require.NoError(t, err)
+	assert.False(t, swapped)
+
+	swapped, err = memory.CompareAndSwap("key", []byte("a"), []byte("b"))
+	require.NoError(t, err)
+	assert.True(t, swapped)
+
+	// an expired key counts as missing
+	require.NoError(t, memory.SetWithTTL("key", []byte("c"), time.Second))
+	clk.Add(time.Second)
+	swapped, err = memory.CompareAndSwap("key", []byte("c"), []byte("d"))
+	require.NoError(t, err)
+	assert.False(t, swapped)
+	swapped, err = memory.CompareAndSwap("key", nil, []byte("d"))
+	require.NoError(t, err)
+	assert.True(t, swapped)
+}
+
+func TestSQLMemoryNilValue(t *testing.T) {
+	memory := newSQLiteMemory(t, clock.New())
+
+	require.NoError(t, memory.Set("key", nil))
+	value, ok, err := memory.Get("key")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, value)
+
+	require.NoError(t, memory.Transaction(func(tx MemoryTx) error {
+		return tx.Set("other", nil)
+	}))
+	_, ok, err = memory.Get("other")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestSQLMemoryPostgresDialect(t *testing.T) {
+	memory := &SQLMemory{dialect: Postgres}
+
+	tests := map[string]string{
+		sqlSwap:           "UPDATE botty_memory SET value = $1, expires_at = NULL WHERE key = $2 AND value = $3 AND (expires_at IS NULL OR expires_at > $4)",
+		sqlInsertVersion:  "INSERT INTO botty_schema_migrations (version) VALUES ($1)",
+		sqlScanLimit:      "SELECT key FROM botty_memory WHERE substr(key, 1, $1) = $2 AND key > $3 AND (expires_at IS NULL OR expires_at > $4) ORDER BY key LIMIT $5",
+		sqlSchemaVersion:  sqlSchemaVersion,
+		sqlInsertIfAbsent: "INSERT INTO botty_memory (key, value, expires_at) VALUES ($1, $2, NULL) ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = NULL WHERE botty_memory.expires_at IS NOT NULL AND botty_memory.expires_at <= $3",
+		sqlSet:            "INSERT INTO botty_memory (key, value, expires_at) VALUES ($1, $2, $3) ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at",
+	}
+	for query, expected := range tests {
+		assert.Equal(t, expected, memory.query(query))
+	}
+
+	// no statement keeps a placeholder of SQLite
+	for _, query := range []string{sqlGet, sqlDelete, sqlDeleteExpired, sqlKeys, sqlScan, sqlReplace} {
+		assert.NotContains(t, memory.query(query), "?", query)
+	}
+
+	assert.Equal(t, "LOCK TABLE botty_schema_migrations IN EXCLUSIVE MODE", memory.migrationsLock())
+	assert.Equal(t, "CREATE TABLE botty_memory (key TEXT PRIMARY KEY, value BYTEA NOT NULL)", sqlMigrations[0](Postgres))
+
+	// SQLite keeps the statements as they are
+	sqlite := &SQLMemory{dialect: SQLite}
+	assert.Equal(t, sqlSwap, sqlite.query(sqlSwap))
+	assert.Equal(t, sqlLockMigrations, sqlite.migrationsLock())
+	assert.Equal(t, "CREATE TABLE botty_memory (key TEXT PRIMARY KEY, value BLOB NOT NULL)", sqlMigrations[0](SQLite))
+}
+
+func TestSQLMemoryTransaction(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+	store.SetMemory(newSQLiteMemory(t, clock.New()))
+	testStorageBatch(t, store)
+}
@@ -1,19 +1,26 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/gillepool/botty/internal/tracing"
 	"go.uber.org/zap"
 )
 
 type Storage struct {
-	logger  *zap.Logger
-	mu      sync.RWMutex
-	memory  Memory
-	encoder MemoryEncoder
+	logger   *zap.Logger
+	mu       sync.RWMutex
+	memory   Memory
+	encoder  MemoryEncoder
+	observer Observer
 }
 
 // The Memory interface allows the bot to persist data as key-value pairs.
@@ -22,19 +29,45 @@ type Memory interface {
 	Get(key string) ([]byte, bool, error)
 	Delete(key string) (bool, error)
 	Keys() ([]string, error)
+
+	// Scan returns up to limit keys that start with the prefix, beginning at
+	// the cursor. The initial cursor is empty and so is the returned cursor
+	// once all keys were returned. A limit of zero or less means no limit.
+	// Backends may return slightly more or fewer keys than the limit.
+	Scan(prefix, cursor string, limit int) (keys []string, next string, err error)
+
 	Close() error
 }
 
+// A Pinger is a Memory that can check whether its backend responds.
+type Pinger interface {
+	Ping() error
+}
+
+// ErrExpiryNotSupported is returned by Storage.SetWithTTL if the Memory does
+// not implement the ExpiringMemory interface.
+var ErrExpiryNotSupported = errors.New("memory does not support expiring keys")
+
+// An ExpiringMemory is a Memory that can delete keys automatically after a
+// time to live (TTL). Setting a key via Memory.Set removes its TTL.
+type ExpiringMemory interface {
+	Memory
+	SetWithTTL(key string, value []byte, ttl time.Duration) error
+}
+
 // A MemoryEncoder is used to encode and decode any values that are stored in
 // the Memory. The default implementation that is used by the Storage uses a
-// JSON encoding.
+// JSON encoding. Use a VersionedEncoder to store values as gob, MessagePack or
+// protobuf and to upgrade values whose type has changed.
 type MemoryEncoder interface {
 	Encode(value interface{}) ([]byte, error)
 	Decode(data []byte, target interface{}) error
 }
 
-type inMemory struct {
-	data map[string][]byte
+// An Observer is notified about every operation on the Memory of a Storage,
+// e.g. to collect metrics. The backend is the type name of the Memory.
+type Observer interface {
+	ObserveOperation(backend, operation string, duration time.Duration, err error)
 }
 
 type jsonEncoder struct{}
@@ -42,7 +75,7 @@ type jsonEncoder struct{}
 func NewStorage(logger *zap.Logger) *Storage {
 	return &Storage{
 		logger:  logger,
-		memory:  newInMemory(),
+		memory:  NewInMemory(clock.New()),
 		encoder: new(jsonEncoder),
 	}
 }
@@ -56,21 +89,82 @@ func (s *Storage) Close() error {
 }
 
 func (s *Storage) Set(key string, value interface{}) error {
-	data, err := s.encoder.Encode(value)
+	return s.SetContext(context.Background(), key, value)
+}
+
+// SetContext is like Set but records the operation as child span of the span
+// in the context (see package tracing).
+func (s *Storage) SetContext(ctx context.Context, key string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.set(ctx, key, value)
+}
+
+// set encodes and stores the value. The caller must hold the write lock.
+func (s *Storage) set(ctx context.Context, key string, value interface{}) error {
+	data, err := s.encode(key, value)
 	if err != nil {
-		return fmt.Errorf("Failed to encode value %w ", err)
+		return err
 	}
-	s.mu.Lock()
+
+	done := s.operation(ctx, "set", key)
 	err = s.memory.Set(key, data)
-	s.mu.Unlock()
+	done(err)
+	return err
+}
+
+// SetWithTTL stores the value under the key and deletes it once the TTL has
+// passed. A TTL that is zero or negative means that the key never expires.
+// If the Memory does not implement the ExpiringMemory interface,
+// ErrExpiryNotSupported is returned.
+func (s *Storage) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
+	return s.SetWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// SetWithTTLContext is like SetWithTTL but records the operation as child span
+// of the span in the context (see package tracing).
+func (s *Storage) SetWithTTLContext(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ttl <= 0 {
+		return s.set(ctx, key, value)
+	}
+
+	memory, ok := as[ExpiringMemory](s.memory)
+	if !ok {
+		return ErrExpiryNotSupported
+	}
+
+	data, err := s.encode(key, value)
+	if err != nil {
+		return err
+	}
+
+	done := s.operation(ctx, "set_ttl", key)
+	err = memory.SetWithTTL(key, data, ttl)
+	done(err)
 	return err
 }
 
 func (s *Storage) Get(key string, value interface{}) (bool, error) {
+	return s.GetContext(context.Background(), key, value)
+}
+
+// GetContext is like Get but records the operation as child span of the span
+// in the context (see package tracing).
+func (s *Storage) GetContext(ctx context.Context, key string, value interface{}) (bool, error) {
 	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(ctx, key, value)
+}
+
+// get fetches and decodes the value. The caller must hold the read or write
+// lock.
+func (s *Storage) get(ctx context.Context, key string, value interface{}) (bool, error) {
+	done := s.operation(ctx, "get", key)
 	data, ok, err := s.memory.Get(key)
-	fmt.Println("Data ", data, ok)
-	s.mu.RUnlock()
+	done(err)
 	if err != nil {
 		return false, fmt.Errorf("Failed to fetch value %w ", err)
 	}
@@ -78,73 +172,158 @@ func (s *Storage) Get(key string, value interface{}) (bool, error) {
 		return ok, nil
 	}
 
-	err = s.encoder.Decode(data, value)
-	if err != nil {
-		return false, fmt.Errorf("Failed to Decode value %w ", err)
+	if err := s.decode(key, data, value); err != nil {
+		return false, err
 	}
 	return true, nil
 }
 
+// encode encodes the value of the key with the MemoryEncoder.
+func (s *Storage) encode(key string, value interface{}) ([]byte, error) {
+	data, err := s.encoder.Encode(value)
+	if err != nil {
+		return nil, &EncodeError{Key: key, Type: reflect.TypeOf(value), Err: err}
+	}
+	return data, nil
+}
+
+// decode decodes the data of the key into value with the MemoryEncoder.
+func (s *Storage) decode(key string, data []byte, value interface{}) error {
+	if err := s.encoder.Decode(data, value); err != nil {
+		target := reflect.TypeOf(value)
+		if target.Kind() == reflect.Ptr {
+			target = target.Elem()
+		}
+		return &DecodeError{Key: key, Type: target, Err: err}
+	}
+	return nil
+}
+
 func (s *Storage) Delete(key string) (bool, error) {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete but records the operation as child span of the
+// span in the context (see package tracing).
+func (s *Storage) DeleteContext(ctx context.Context, key string) (bool, error) {
 	s.mu.Lock()
+	done := s.operation(ctx, "delete", key)
 	ok, err := s.memory.Delete(key)
+	done(err)
 	s.mu.Unlock()
 	return ok, err
 }
 
 func (s *Storage) Keys() ([]string, error) {
+	return s.KeysContext(context.Background())
+}
+
+// KeysContext is like Keys but records the operation as child span of the span
+// in the context (see package tracing).
+func (s *Storage) KeysContext(ctx context.Context) ([]string, error) {
 	s.mu.RLock()
+	done := s.operation(ctx, "keys", "")
 	keys, err := s.memory.Keys()
+	done(err)
 	s.mu.RUnlock()
 
 	sort.Strings(keys)
 	return keys, err
 }
 
-func (s *Storage) SetMemory(m Memory) {
-	s.mu.RLock()
-	s.memory = m
-	s.mu.RUnlock()
+// Scan returns up to limit keys that start with the prefix, beginning at the
+// cursor. Pass an empty cursor to start a new scan and the returned cursor to
+// continue it. The scan is complete once the returned cursor is empty.
+func (s *Storage) Scan(prefix, cursor string, limit int) ([]string, string, error) {
+	return s.ScanContext(context.Background(), prefix, cursor, limit)
 }
 
-func (s *Storage) SetMemoryEncoder(memoryEncoder MemoryEncoder) {
+// ScanContext is like Scan but records the operation as child span of the span
+// in the context (see package tracing).
+func (s *Storage) ScanContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
 	s.mu.RLock()
-	s.encoder = memoryEncoder
-	s.mu.RUnlock()
+	defer s.mu.RUnlock()
+
+	done := s.operation(ctx, "scan", prefix)
+	keys, next, err := s.memory.Scan(prefix, cursor, limit)
+	done(err)
+	return keys, next, err
 }
 
-func (m *inMemory) Close() error {
-	m.data = map[string][]byte{}
-	return nil
+// Ping returns an error if the backend of the Memory does not respond. A Memory
+// that does not implement the Pinger interface is always considered to be up.
+func (s *Storage) Ping(ctx context.Context) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := as[Pinger](s.memory)
+	if !ok {
+		return nil
+	}
+
+	done := s.operation(ctx, "ping", "")
+	err := p.Ping()
+	done(err)
+	return err
 }
 
-func newInMemory() *inMemory {
-	return &inMemory{data: map[string][]byte{}}
+func (s *Storage) SetMemory(m Memory) {
+	s.mu.Lock()
+	s.memory = m
+	s.mu.Unlock()
 }
 
-func (m *inMemory) Delete(key string) (bool, error) {
-	_, ok := m.data[key]
-	delete(m.data, key)
-	return ok, nil
+func (s *Storage) SetMemoryEncoder(memoryEncoder MemoryEncoder) {
+	s.mu.Lock()
+	s.encoder = memoryEncoder
+	s.mu.Unlock()
 }
 
-func (m *inMemory) Set(key string, value []byte) error {
-	m.data[key] = value
-	return nil
+// SetObserver sets the Observer that is notified about all operations on the
+// Memory. Passing nil disables the notifications, which is the default.
+func (s *Storage) SetObserver(o Observer) {
+	s.mu.Lock()
+	s.observer = o
+	s.mu.Unlock()
 }
 
-func (m *inMemory) Get(key string) ([]byte, bool, error) {
-	value, ok := m.data[key]
-	return value, ok, nil
+// operation starts to measure an operation on the Memory. The returned function
+// must be called with the result of the operation to end its span and to
+// notify the Observer. The caller must hold the lock of the Storage.
+func (s *Storage) operation(ctx context.Context, name, key string) func(error) {
+	backend := backendName(s.memory)
+	_, span := tracing.Start(ctx, "storage."+name)
+	span.SetAttribute("backend", backend)
+	if key != "" {
+		span.SetAttribute("key", key)
+	}
+
+	start := time.Now()
+	return func(err error) {
+		span.SetError(err)
+		span.End()
+		if s.observer != nil {
+			s.observer.ObserveOperation(backend, name, time.Since(start), err)
+		}
+	}
 }
 
-func (m *inMemory) Keys() ([]string, error) {
-	keys := make([]string, 0, len(m.data))
-	for k := range m.data {
-		keys = append(keys, k)
+// backendName returns the name of the type of the Memory, e.g. "RedisMemory".
+// Wrappers like the ones of Storage.Namespace report the Memory they wrap.
+func backendName(m Memory) string {
+	for {
+		w, ok := m.(interface{ Unwrap() Memory })
+		if !ok {
+			break
+		}
+		m = w.Unwrap()
 	}
 
-	return keys, nil
+	t := reflect.TypeOf(m)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
 }
 
 func (jsonEncoder) Encode(value interface{}) ([]byte, error) {
@@ -1,9 +1,15 @@
 package storage
 
 import (
+	"errors"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -34,3 +40,280 @@ func TestStorageSet(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, expected, result)
 }
+
+type profile struct {
+	Name  string
+	Score int
+}
+
+func TestStorageTypedAccessors(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+
+	_, err := GetAs[profile](store, "alice")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.EqualError(t, err, `key "alice" not found`)
+
+	require.NoError(t, SetAs(store, "alice", profile{Name: "Alice", Score: 1}))
+	p, err := GetAs[profile](store, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, profile{Name: "Alice", Score: 1}, p)
+
+	_, err = GetAs[int](store, "alice")
+	var decodeErr *DecodeError
+	require.ErrorAs(t, err, &decodeErr)
+	assert.Equal(t, "alice", decodeErr.Key)
+	assert.Equal(t, reflect.TypeOf(0), decodeErr.Type)
+
+	err = SetAs(store, "broken", func() {})
+	var encodeErr *EncodeError
+	require.ErrorAs(t, err, &encodeErr)
+	assert.Equal(t, "broken", encodeErr.Key)
+}
+
+func TestStorageUpdate(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+
+	increment := func(n int) int { return n + 1 }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := Update(store, "counter", increment)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	n, err := GetAs[int](store, "counter")
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+
+	require.NoError(t, store.Set("text", "hello"))
+	_, err = Update(store, "text", increment)
+	assert.IsType(t, &DecodeError{}, err)
+}
+
+func TestInMemoryExpiry(t *testing.T) {
+	mock := clock.NewMock()
+	store := NewStorage(zaptest.NewLogger(t))
+	memory := NewInMemory(mock)
+	store.SetMemory(memory)
+	defer store.Close()
+
+	require.NoError(t, store.SetWithTTL("cooldown", true, time.Minute))
+	require.NoError(t, store.SetWithTTL("mute", true, time.Hour))
+	require.NoError(t, store.SetWithTTL("forever", true, 0))
+	require.NoError(t, store.SetWithTTL("reset", true, time.Second))
+	require.NoError(t, store.Set("reset", true)) // removes the TTL
+
+	mock.Add(59 * time.Second)
+	ok, err := store.Get("cooldown", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	mock.Add(time.Second)
+	ok, err = store.Get("cooldown", nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	keys, err := store.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"forever", "mute", "reset"}, keys)
+
+	// the janitor deletes expired keys even if they are never accessed
+	mock.Add(time.Hour)
+	require.Eventually(t, func() bool {
+		memory.mu.Lock()
+		defer memory.mu.Unlock()
+		return len(memory.data) == 2
+	}, time.Second, time.Millisecond)
+}
+
+type plainMemory struct{ Memory }
+
+func TestStorageSetWithTTLNotSupported(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+	store.SetMemory(plainMemory{NewInMemory(clock.New())})
+
+	assert.ErrorIs(t, store.SetWithTTL("key", "value", time.Minute), ErrExpiryNotSupported)
+	assert.NoError(t, store.SetWithTTL("key", "value", 0))
+}
+
+func TestStorageUpdateAcrossReplicas(t *testing.T) {
+	// two bots that share the same backend
+	shared := NewInMemory(clock.New())
+	replicas := []*Storage{NewStorage(zaptest.NewLogger(t)), NewStorage(zaptest.NewLogger(t))}
+	for _, s := range replicas {
+		s.SetMemory(shared)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(s *Storage) {
+			defer wg.Done()
+			var karma map[string]int
+			err := s.Update("karma", &karma, func(exists bool) error {
+				if !exists {
+					karma = map[string]int{}
+				}
+				karma["alice"]++
+				return nil
+			})
+			assert.NoError(t, err)
+		}(replicas[i%2])
+	}
+	wg.Wait()
+
+	karma, err := GetAs[map[string]int](replicas[0], "karma")
+	require.NoError(t, err)
+	assert.Equal(t, 20, karma["alice"])
+
+	errAbort := errors.New("abort")
+	var value map[string]int
+	assert.Equal(t, errAbort, replicas[0].Update("karma", &value, func(bool) error { return errAbort }))
+	assert.Error(t, replicas[0].Update("karma", value, func(bool) error { return nil }), "needs a pointer")
+}
+
+func TestStorageIncrement(t *testing.T) {
+	for name, memory := range map[string]Memory{
+		"atomic": NewInMemory(clock.New()),
+		"plain":  plainMemory{NewInMemory(clock.New())},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := NewStorage(zaptest.NewLogger(t))
+			store.SetMemory(memory)
+
+			n, err := store.Increment("counter", 5)
+			require.NoError(t, err)
+			assert.Equal(t, int64(5), n)
+
+			n, err = store.Increment("counter", -2)
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), n)
+
+			counter, err := GetAs[int](store, "counter")
+			require.NoError(t, err)
+			assert.Equal(t, 3, counter)
+
+			require.NoError(t, store.Set("text", "hello"))
+			_, err = store.Increment("text", 1)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestInMemoryCompareAndSwap(t *testing.T) {
+	m := NewInMemory(clock.New())
+
+	ok, err := m.CompareAndSwap("key", nil, []byte("a"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = m.CompareAndSwap("key", nil, []byte("b"))
+	require.NoError(t, err)
+	assert.False(t, ok, "key exists already")
+
+	ok, err = m.CompareAndSwap("key", []byte("b"), []byte("c"))
+	require.NoError(t, err)
+	assert.False(t, ok, "value does not match")
+
+	ok, err = m.CompareAndSwap("key", []byte("a"), []byte("c"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	value, _, _ := m.Get("key")
+	assert.Equal(t, "c", string(value))
+}
+
+func TestStorageScan(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+	for _, key := range []string{"karma:bob", "karma:alice", "karma:carol", "quote:1", "karma"} {
+		require.NoError(t, store.Set(key, 1))
+	}
+
+	var pages [][]string
+	cursor := ""
+	for {
+		keys, next, err := store.Scan("karma:", cursor, 2)
+		require.NoError(t, err)
+		pages = append(pages, keys)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	assert.Equal(t, [][]string{{"karma:alice", "karma:bob"}, {"karma:carol"}}, pages)
+
+	keys, next, err := store.Scan("", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, keys, 5)
+	assert.Empty(t, next)
+}
+
+func TestStorageNamespace(t *testing.T) {
+	store := NewStorage(zaptest.NewLogger(t))
+	karma := store.Namespace("karma")
+	quotes := store.Namespace("quotes")
+
+	require.NoError(t, karma.Set("alice", 1))
+	require.NoError(t, quotes.Set("alice", "hello"))
+	_, err := karma.Increment("alice", 1)
+	require.NoError(t, err)
+	require.NoError(t, karma.SetWithTTL("bob", 1, time.Minute))
+
+	n, err := GetAs[int](karma, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	keys, err := karma.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, keys)
+
+	keys, _, err = karma.Scan("b", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob"}, keys)
+
+	keys, err = store.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"karma:alice", "karma:bob", "quotes:alice"}, keys)
+
+	// closing a namespace keeps the shared memory
+	require.NoError(t, quotes.Close())
+	ok, err := store.Get("quotes:alice", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// namespaces only support what the shared memory supports
+	store.SetMemory(plainMemory{NewInMemory(clock.New())})
+	assert.ErrorIs(t, store.Namespace("karma").SetWithTTL("bob", 1, time.Minute), ErrExpiryNotSupported)
+	_, err = store.Namespace("karma").Increment("alice", 1)
+	assert.NoError(t, err)
+
+	// existing namespaces follow the new memory of their parent
+	assert.ErrorIs(t, karma.SetWithTTL("bob", 1, time.Minute), ErrExpiryNotSupported)
+	n, err = GetAs[int](karma, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	keys, err = quotes.Keys()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestRedisVersion(t *testing.T) {
+	info := "# Server\r\nredis_version:7.4.1\r\nredis_mode:standalone\r\n"
+	major, minor := redisVersion(info)
+	assert.Equal(t, 7, major)
+	assert.Equal(t, 4, minor)
+
+	major, minor = redisVersion("# Server\r\nredis_version:6.2\r\n")
+	assert.Equal(t, 6, major)
+	assert.Equal(t, 2, minor)
+
+	major, minor = redisVersion("")
+	assert.Zero(t, major)
+	assert.Zero(t, minor)
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrNotFound is matched by the errors of GetAs if the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// A NotFoundError is returned by GetAs if the key does not exist. It matches
+// ErrNotFound via errors.Is.
+type NotFoundError struct {
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("key %q not found", e.Key)
+}
+
+// Is reports whether the target is ErrNotFound.
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// An EncodeError is returned if a value cannot be encoded by the
+// MemoryEncoder.
+type EncodeError struct {
+	Key  string
+	Type reflect.Type // the type of the value
+	Err  error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("failed to encode %v for key %q: %v", e.Type, e.Key, e.Err)
+}
+
+func (e *EncodeError) Unwrap() error { return e.Err }
+
+// A DecodeError is returned if a stored value cannot be decoded into the
+// requested type by the MemoryEncoder, e.g. because it was stored with another
+// type.
+type DecodeError struct {
+	Key  string
+	Type reflect.Type // the type that the value should be decoded into
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode key %q as %v: %v", e.Key, e.Type, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// GetAs returns the value of the key decoded as T. If the key does not exist,
+// it returns a *NotFoundError.
+func GetAs[T any](s *Storage, key string) (T, error) {
+	var value T
+	ok, err := s.Get(key, &value)
+	if err != nil {
+		return value, err
+	}
+	if !ok {
+		return value, &NotFoundError{Key: key}
+	}
+	return value, nil
+}
+
+// SetAs stores the value under the key.
+func SetAs[T any](s *Storage, key string, value T) error {
+	return s.Set(key, value)
+}
+
+// Update replaces the value of the key by the result of fn and returns the new
+// value. If the key does not exist, fn receives the zero value of T. The update
+// is atomic as described for Storage.Update, so fn may be called more than
+// once and it must not use the Storage itself.
+func Update[T any](s *Storage, key string, fn func(T) T) (T, error) {
+	var value T
+	err := s.Update(key, &value, func(bool) error {
+		value = fn(value)
+		return nil
+	})
+	return value, err
+}
@@ -0,0 +1,213 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+// WriterExporter writes each span as a single line of JSON.
+type WriterExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	w   io.Writer
+}
+
+// NewWriterExporter creates an Exporter that writes the spans to w, e.g. to
+// os.Stdout. If w is an io.Closer, it is closed on Shutdown.
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{enc: json.NewEncoder(w), w: w}
+}
+
+// CreateFileExporter creates an Exporter that appends the spans to the file at
+// the given path. The file is created if it does not exist.
+func CreateFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+
+	return NewWriterExporter(f), nil
+}
+
+// ExportSpans implements the Exporter interface.
+func (e *WriterExporter) ExportSpans(_ context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, span := range spans {
+		if err := e.enc.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown implements the Exporter interface.
+func (e *WriterExporter) Shutdown(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if c, ok := e.w.(io.Closer); ok && e.w != os.Stdout && e.w != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector using the OTLP/HTTP
+// protocol with JSON encoding.
+type OTLPExporter struct {
+	Endpoint string // the URL of the traces endpoint, e.g. http://localhost:4318/v1/traces
+	Service  string // reported as service.name resource attribute
+	Client   *http.Client
+}
+
+// NewOTLPExporter creates an Exporter that sends the spans of the given service
+// to the collector at the endpoint. If the endpoint has no path, the default
+// path /v1/traces is used.
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if i := strings.Index(endpoint, "://"); i < 0 || !strings.Contains(endpoint[i+3:], "/") {
+		endpoint += "/v1/traces"
+	}
+
+	return &OTLPExporter{
+		Endpoint: endpoint,
+		Service:  service,
+		Client:   http.DefaultClient,
+	}
+}
+
+// ExportSpans implements the Exporter interface.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send spans: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Shutdown implements the Exporter interface.
+func (e *OTLPExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// The following types implement the JSON encoding of the OTLP
+// ExportTraceServiceRequest. Note that OTLP encodes IDs as hex strings and
+// 64 bit integers as decimal strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceID           TraceID         `json:"traceId"`
+		SpanID            SpanID          `json:"spanId"`
+		ParentSpanID      SpanID          `json:"parentSpanId"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+func (e *OTLPExporter) request(spans []SpanData) otlpRequest {
+	converted := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		for _, attr := range span.Attributes {
+			s.Attributes = append(s.Attributes, otlpAttribute{Key: attr.Key, Value: otlpValue{StringValue: attr.Value}})
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		converted[i] = s
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: e.Service}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/gillepool/botty"},
+			Spans: converted,
+		}},
+	}}}
+}
@@ -0,0 +1,273 @@
+// Package tracing records spans that show the causal chain of events, event
+// handlers, storage operations and sent messages. The spans use W3C trace
+// context identifiers and can be exported to any OpenTelemetry collector via
+// OTLP/HTTP or written to a file.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// A TraceID identifies all spans that belong to the same trace.
+type TraceID [16]byte
+
+// A SpanID identifies a single span within a trace.
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeros.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// IsValid reports whether the ID is not all zeros.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// MarshalText encodes the ID as hex string.
+func (id TraceID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+
+// MarshalText encodes the ID as hex string. The zero SpanID is encoded as
+// empty string.
+func (id SpanID) MarshalText() ([]byte, error) {
+	if !id.IsValid() {
+		return []byte{}, nil
+	}
+	return []byte(id.String()), nil
+}
+
+// An Attribute is a key-value pair that describes a span.
+type Attribute struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// SpanData is the immutable record of a span that has ended. It is passed to
+// the Exporter.
+type SpanData struct {
+	TraceID    TraceID     `json:"trace_id"`
+	SpanID     SpanID      `json:"span_id"`
+	ParentID   SpanID      `json:"parent_id"`
+	Name       string      `json:"name"`
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end"`
+	Attributes []Attribute `json:"attributes,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// A Span measures a single operation. All methods of a nil Span are no-ops,
+// so callers never need to check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SetAttribute adds a key-value pair that describes the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.data.Attributes = append(s.data.Attributes, Attribute{Key: key, Value: fmt.Sprint(value)})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.data.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and passes it to the exporter of its Tracer. Any
+// further calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	s.tracer.export(data)
+}
+
+// TraceID returns the ID of the trace the span belongs to, or the zero ID for
+// a nil Span.
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.data.TraceID
+}
+
+// SpanID returns the ID of the span, or the zero ID for a nil Span.
+func (s *Span) SpanID() SpanID {
+	if s == nil {
+		return SpanID{}
+	}
+	return s.data.SpanID
+}
+
+type ctxKey struct{}
+
+// SpanFromContext returns the span that is currently active in the context or
+// nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(ctxKey{}).(*Span)
+	return span
+}
+
+// ContextWithSpan returns a copy of the context in which the span is active.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, ctxKey{}, span)
+}
+
+// Start starts a child span of the span that is active in the context. If the
+// context does not contain a span, tracing is disabled and Start returns the
+// context together with a nil Span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name)
+}
+
+// A Tracer creates spans and passes them in batches to an Exporter.
+type Tracer struct {
+	exporter Exporter
+	logger   *zap.Logger
+	spans    chan SpanData
+	stop     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+// batchSize is the number of spans that are exported at once. Spans are also
+// exported if they waited longer than the flushInterval.
+const (
+	batchSize     = 128
+	flushInterval = 5 * time.Second
+)
+
+// NewTracer creates a Tracer that exports all spans via the given exporter.
+// The caller must call Shutdown to export the remaining spans.
+func NewTracer(exporter Exporter, logger *zap.Logger) *Tracer {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	t := &Tracer{
+		exporter: exporter,
+		logger:   logger,
+		spans:    make(chan SpanData, 4*batchSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go t.loop()
+	return t
+}
+
+// Start starts a new span. If the context already contains a span, the new
+// span becomes its child, otherwise it starts a new trace. A nil Tracer
+// returns the context together with a nil Span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, data: SpanData{Name: name, Start: time.Now()}}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.data.TraceID = parent.data.TraceID
+		span.data.ParentID = parent.data.SpanID
+	} else {
+		_, _ = rand.Read(span.data.TraceID[:])
+	}
+	_, _ = rand.Read(span.data.SpanID[:])
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// Shutdown exports all remaining spans and shuts down the Exporter. Spans that
+// end afterwards are discarded.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.once.Do(func() { close(t.stop) })
+
+	select {
+	case <-t.stopped:
+		return t.exporter.Shutdown(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Tracer) export(data SpanData) {
+	select {
+	case <-t.stop:
+	case t.spans <- data:
+	default:
+		t.logger.Warn("Dropped span because the export queue is full", zap.String("span", data.Name))
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(context.Background(), batch); err != nil {
+			t.logger.Error("Failed to export spans", zap.Int("count", len(batch)), zap.Error(err))
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case data := <-t.spans:
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case data := <-t.spans:
+					batch = append(batch, data)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
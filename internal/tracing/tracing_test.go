@@ -0,0 +1,204 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gillepool/botty/internal/adapter"
+	"github.com/gillepool/botty/internal/brain"
+	"github.com/gillepool/botty/internal/storage"
+	"github.com/gillepool/botty/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (e *recordingExporter) ExportSpans(_ context.Context, spans []tracing.SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(context.Context) error { return nil }
+
+func (e *recordingExporter) byName() map[string]tracing.SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	spans := map[string]tracing.SpanData{}
+	for _, span := range e.spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestStartWithoutTracer(t *testing.T) {
+	ctx, span := tracing.Start(context.Background(), "disabled")
+	assert.Nil(t, span)
+	assert.Nil(t, tracing.SpanFromContext(ctx))
+
+	// all methods of a nil span are no-ops
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+	assert.False(t, span.TraceID().IsValid())
+}
+
+func TestTracerSpanHierarchy(t *testing.T) {
+	exporter := new(recordingExporter)
+	tracer := tracing.NewTracer(exporter, zaptest.NewLogger(t))
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := tracing.Start(ctx, "child")
+	child.SetAttribute("attempt", 1)
+	child.SetError(errors.New("failed"))
+	child.End()
+	child.End() // ignored
+	root.End()
+
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	require.Len(t, exporter.spans, 2)
+	spans := exporter.byName()
+	assert.True(t, spans["root"].TraceID.IsValid())
+	assert.False(t, spans["root"].ParentID.IsValid())
+	assert.Equal(t, spans["root"].TraceID, spans["child"].TraceID)
+	assert.Equal(t, spans["root"].SpanID, spans["child"].ParentID)
+	assert.Equal(t, []tracing.Attribute{{Key: "attempt", Value: "1"}}, spans["child"].Attributes)
+	assert.Equal(t, "failed", spans["child"].Error)
+}
+
+func TestBrainAndStorageSpans(t *testing.T) {
+	exporter := new(recordingExporter)
+	tracer := tracing.NewTracer(exporter, zaptest.NewLogger(t))
+	store := storage.NewStorage(zaptest.NewLogger(t))
+
+	b := brain.New(brain.WithLogger(zaptest.NewLogger(t)), brain.WithTracer(tracer))
+	b.RegisterHandlerWithOptions(func(ctx context.Context, evt string) error {
+		return store.SetContext(ctx, "key", evt)
+	}, brain.HandlerOptions{Name: "remember"})
+
+	done := make(chan struct{})
+	go func() {
+		b.HandleEvents()
+		close(done)
+	}()
+
+	_, err := b.EmitAndWait(context.Background(), "hello")
+	require.NoError(t, err)
+	require.NoError(t, b.Shutdown(context.Background()))
+	<-done
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	spans := exporter.byName()
+	event, handler, set := spans["event string"], spans["handler remember"], spans["storage.set"]
+	assert.Equal(t, event.SpanID, handler.ParentID)
+	assert.Equal(t, handler.SpanID, set.ParentID)
+	assert.Equal(t, event.TraceID, set.TraceID)
+	assert.Contains(t, set.Attributes, tracing.Attribute{Key: "backend", Value: "InMemory"})
+	assert.Contains(t, spans, "event events.ShutdownEvent")
+}
+
+type fakeAdapter struct{ sent []string }
+
+func (a *fakeAdapter) RegisterAt(*brain.Brain) {}
+func (a *fakeAdapter) Close() error            { return nil }
+
+func (a *fakeAdapter) Send(text, channel string) error {
+	a.sent = append(a.sent, channel+": "+text)
+	return nil
+}
+
+func TestHandlerSpansOfStorageAndAdapter(t *testing.T) {
+	exporter := new(recordingExporter)
+	tracer := tracing.NewTracer(exporter, zaptest.NewLogger(t))
+	store := storage.NewStorage(zaptest.NewLogger(t))
+	fake := new(fakeAdapter)
+	traced := adapter.Trace(fake, tracer)
+
+	ctx, span := tracer.Start(context.Background(), "handler")
+	_, err := store.IncrementContext(ctx, "count", 1)
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, store.UpdateContext(ctx, "count", &count, func(bool) error { count++; return nil }))
+	require.NoError(t, store.BatchContext(ctx, func(tx *storage.Tx) error { return tx.Set("other", count) }))
+	_, _, err = store.ScanContext(ctx, "", "", 10)
+	require.NoError(t, err)
+	require.NoError(t, adapter.SendContext(ctx, traced, "hello", "general"))
+	span.End()
+
+	require.NoError(t, traced.Send("without parent", "general"))
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	spans := exporter.byName()
+	for _, name := range []string{"storage.increment", "storage.compare_and_swap", "storage.batch", "storage.scan"} {
+		assert.Equal(t, span.SpanID(), spans[name].ParentID, name)
+	}
+
+	var sends []tracing.SpanData
+	for _, s := range exporter.spans {
+		if s.Name == "adapter.send" {
+			sends = append(sends, s)
+		}
+	}
+	require.Len(t, sends, 2)
+	assert.Equal(t, span.SpanID(), sends[0].ParentID)
+	assert.Contains(t, sends[0].Attributes, tracing.Attribute{Key: "channel", Value: "general"})
+	assert.False(t, sends[1].ParentID.IsValid())
+	assert.Equal(t, []string{"general: hello", "general: without parent"}, fake.sent)
+}
+
+func TestWriterExporter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tracer := tracing.NewTracer(tracing.NewWriterExporter(buf), zaptest.NewLogger(t))
+
+	_, span := tracer.Start(context.Background(), "operation")
+	span.End()
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, "operation", decoded["name"])
+	assert.Equal(t, span.TraceID().String(), decoded["trace_id"])
+	assert.Equal(t, "", decoded["parent_id"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(body, &request))
+	}))
+	defer server.Close()
+
+	tracer := tracing.NewTracer(tracing.NewOTLPExporter(server.URL, "botty"), zaptest.NewLogger(t))
+	_, span := tracer.Start(context.Background(), "operation")
+	span.SetError(errors.New("failed"))
+	span.End()
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	resourceSpans := request["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := resourceSpans["resource"].(map[string]interface{})
+	assert.Equal(t, "service.name", resource["attributes"].([]interface{})[0].(map[string]interface{})["key"])
+
+	exported := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "operation", exported["name"])
+	assert.Equal(t, span.TraceID().String(), exported["traceId"])
+	assert.Equal(t, span.SpanID().String(), exported["spanId"])
+	assert.Equal(t, map[string]interface{}{"code": 2.0, "message": "failed"}, exported["status"])
+}